@@ -8,6 +8,7 @@ package broker
 import (
 	"context"
 	"log"
+	"net/http"
 
 	"github.com/kelseyhightower/envconfig"
 	"go.uber.org/zap"
@@ -15,6 +16,7 @@ import (
 	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
 	eventingclient "knative.dev/eventing/pkg/client/injection/client"
 	brokerinformer "knative.dev/eventing/pkg/client/injection/informers/eventing/v1/broker"
+	triggerinformer "knative.dev/eventing/pkg/client/injection/informers/eventing/v1/trigger"
 	brokerreconciler "knative.dev/eventing/pkg/client/injection/reconciler/eventing/v1/broker"
 	kubeclient "knative.dev/pkg/client/injection/kube/client"
 	"knative.dev/pkg/configmap"
@@ -71,5 +73,8 @@ func NewController(
 		Handler:    controller.HandleAll(impl.EnqueueControllerOf),
 	})
 
+	// cmd/controller serves the default mux.
+	http.Handle(topologyPath, topologyHandler(brokerInformer.Lister(), triggerinformer.Get(ctx).Lister()))
+
 	return impl
 }
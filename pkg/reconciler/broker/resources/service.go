@@ -9,11 +9,63 @@ import (
 	"fmt"
 	"github.com/google/go-cmp/cmp"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
 	"knative.dev/pkg/kmeta"
 	servingv1 "knative.dev/serving/pkg/apis/serving/v1"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	// DeliveryWorkersAnnotation sets how many deliveries a broker has in
+	// flight across all of its triggers.
+	DeliveryWorkersAnnotation = "glass-broker.tableflip.dev/delivery-workers"
+	// DeliveryQueueSizeAnnotation sets how many deliveries each trigger may
+	// have waiting before ingress answers 429.
+	DeliveryQueueSizeAnnotation = "glass-broker.tableflip.dev/delivery-queue-size"
+	// DeliveryMaxInFlightAnnotation sets how many deliveries a trigger has in
+	// flight, unless the Trigger sets its own.
+	DeliveryMaxInFlightAnnotation = "glass-broker.tableflip.dev/delivery-max-in-flight"
+	// DeliveryTimeoutAnnotation is how long, as a Go duration, each delivery
+	// attempt may take when neither the Trigger's nor the Broker's
+	// DeliverySpec sets a timeout.
+	DeliveryTimeoutAnnotation = "glass-broker.tableflip.dev/delivery-timeout"
+	// QueueDepthAnnotation sets how many accepted events a broker holds
+	// before ingress answers 429.
+	QueueDepthAnnotation = "glass-broker.tableflip.dev/queue-depth"
+	// QueueMemoryAnnotation sets the memory budget, as a quantity like
+	// "64Mi", for the events a broker holds before ingress answers 429.
+	QueueMemoryAnnotation = "glass-broker.tableflip.dev/queue-memory"
+	// CircuitBreakerFailuresAnnotation is the run of failed attempts that
+	// opens a subscriber's circuit, "0" turns circuit breaking off.
+	CircuitBreakerFailuresAnnotation = "glass-broker.tableflip.dev/circuit-breaker-failures"
+	// CircuitBreakerOpenTimeoutAnnotation is how long, as a Go duration, a
+	// circuit stays open before a probe is let through.
+	CircuitBreakerOpenTimeoutAnnotation = "glass-broker.tableflip.dev/circuit-breaker-open-timeout"
+	// WALAnnotation turns on the dataplane write-ahead log. The value picks
+	// the volume backing it: "emptyDir", or "pvc:<claim name>".
+	WALAnnotation = "glass-broker.tableflip.dev/wal"
+	// DedupeWindowAnnotation turns on ingress deduplication by (source, id).
+	// The value, a Go duration, is how long an event is remembered.
+	DedupeWindowAnnotation = "glass-broker.tableflip.dev/dedupe-window"
+	// DedupeSizeAnnotation caps how many events the dedupe window remembers.
+	DedupeSizeAnnotation = "glass-broker.tableflip.dev/dedupe-size"
+
+	// HistorySizeAnnotation sets how many recent events the dataplane keeps
+	// for inspection, "0" turns the history off.
+	HistorySizeAnnotation = "glass-broker.tableflip.dev/history-size"
+	// HistoryMemoryAnnotation sets the memory budget, as a quantity like
+	// "16Mi", for the history.
+	HistoryMemoryAnnotation = "glass-broker.tableflip.dev/history-memory"
+	// TraceSizeAnnotation sets how many recent events the dataplane keeps
+	// delivery records for, "0" turns them off.
+	TraceSizeAnnotation = "glass-broker.tableflip.dev/trace-size"
+
+	walVolumeName = "wal"
+	walMountPath  = "/var/run/glass-broker/wal"
 )
 
 func GenerateServiceName(broker *eventingv1.Broker) string {
@@ -28,6 +80,9 @@ type Args struct {
 func IsOutOfDate(a, b *servingv1.Service) bool {
 	at := a.Spec.ConfigurationSpec.Template
 	bt := b.Spec.ConfigurationSpec.Template
+	if !cmp.Equal(at.Spec.Volumes, bt.Spec.Volumes) {
+		return true
+	}
 	for _, ac := range at.Spec.Containers {
 		if ac.Name == "user-container" {
 			for _, bc := range bt.Spec.Containers {
@@ -60,12 +115,163 @@ func makePodSpec(args *Args) corev1.PodSpec {
 			}, {
 				Name:  "KUBERNETES_MIN_VERSION",
 				Value: "v1.21.0",
+			}, {
+				// The Knative broker metrics domain, so dashboards made
+				// for the MT broker read GlassBroker too.
+				Name:  "METRICS_DOMAIN",
+				Value: "knative.dev/internal/eventing",
 			}},
 		}},
 	}
+	podSpec.Containers[0].Env = append(podSpec.Containers[0].Env, deliveryEnv(args.Broker)...)
+	podSpec.Containers[0].Env = append(podSpec.Containers[0].Env, queueEnv(args.Broker)...)
+	podSpec.Containers[0].Env = append(podSpec.Containers[0].Env, circuitBreakerEnv(args.Broker)...)
+	podSpec.Containers[0].Env = append(podSpec.Containers[0].Env, dedupeEnv(args.Broker)...)
+	podSpec.Containers[0].Env = append(podSpec.Containers[0].Env, historyEnv(args.Broker)...)
+	if vol := walVolume(args.Broker); vol != nil {
+		podSpec.Volumes = append(podSpec.Volumes, *vol)
+		podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      walVolumeName,
+			MountPath: walMountPath,
+		})
+		podSpec.Containers[0].Env = append(podSpec.Containers[0].Env, corev1.EnvVar{
+			Name:  "WAL_DIR",
+			Value: walMountPath,
+		})
+	}
 	return podSpec
 }
 
+// deliveryEnv turns the broker delivery annotations into dataplane env vars.
+// Invalid values are ignored and the dataplane defaults are used.
+func deliveryEnv(broker *eventingv1.Broker) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	if v, ok := broker.Annotations[DeliveryWorkersAnnotation]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			env = append(env, corev1.EnvVar{Name: "DELIVERY_WORKERS", Value: strconv.Itoa(n)})
+		}
+	}
+	if v, ok := broker.Annotations[DeliveryQueueSizeAnnotation]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			env = append(env, corev1.EnvVar{Name: "DELIVERY_QUEUE_SIZE", Value: strconv.Itoa(n)})
+		}
+	}
+	if v, ok := broker.Annotations[DeliveryMaxInFlightAnnotation]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			env = append(env, corev1.EnvVar{Name: "DELIVERY_MAX_IN_FLIGHT", Value: strconv.Itoa(n)})
+		}
+	}
+	if v, ok := broker.Annotations[DeliveryTimeoutAnnotation]; ok {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			env = append(env, corev1.EnvVar{Name: "DELIVERY_TIMEOUT", Value: d.String()})
+		}
+	}
+	return env
+}
+
+// circuitBreakerEnv turns the broker circuit breaker annotations into
+// dataplane env vars. Invalid values are ignored and the dataplane defaults
+// are used.
+func circuitBreakerEnv(broker *eventingv1.Broker) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	if v, ok := broker.Annotations[CircuitBreakerFailuresAnnotation]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			env = append(env, corev1.EnvVar{Name: "CIRCUIT_BREAKER_FAILURES", Value: strconv.Itoa(n)})
+		}
+	}
+	if v, ok := broker.Annotations[CircuitBreakerOpenTimeoutAnnotation]; ok {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			env = append(env, corev1.EnvVar{Name: "CIRCUIT_BREAKER_OPEN_TIMEOUT", Value: d.String()})
+		}
+	}
+	return env
+}
+
+// dedupeEnv turns the broker dedupe annotations into dataplane env vars.
+// Invalid values are ignored and the dataplane defaults are used.
+func dedupeEnv(broker *eventingv1.Broker) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	if v, ok := broker.Annotations[DedupeWindowAnnotation]; ok {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			env = append(env, corev1.EnvVar{Name: "DEDUPE_WINDOW", Value: d.String()})
+		}
+	}
+	if v, ok := broker.Annotations[DedupeSizeAnnotation]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			env = append(env, corev1.EnvVar{Name: "DEDUPE_SIZE", Value: strconv.Itoa(n)})
+		}
+	}
+	return env
+}
+
+// historyEnv turns the broker history and delivery record annotations into
+// dataplane env vars. Invalid values are ignored and the dataplane defaults
+// are used.
+func historyEnv(broker *eventingv1.Broker) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	if v, ok := broker.Annotations[HistorySizeAnnotation]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			env = append(env, corev1.EnvVar{Name: "HISTORY_SIZE", Value: strconv.Itoa(n)})
+		}
+	}
+	if v, ok := broker.Annotations[HistoryMemoryAnnotation]; ok {
+		if q, err := resource.ParseQuantity(v); err == nil && q.Sign() > 0 {
+			env = append(env, corev1.EnvVar{Name: "HISTORY_BYTES", Value: strconv.FormatInt(q.Value(), 10)})
+		}
+	}
+	if v, ok := broker.Annotations[TraceSizeAnnotation]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			env = append(env, corev1.EnvVar{Name: "TRACE_SIZE", Value: strconv.Itoa(n)})
+		}
+	}
+	return env
+}
+
+// walVolume returns the volume named by the broker WAL annotation, or nil if
+// the write-ahead log is off or the annotation is not understood.
+func walVolume(broker *eventingv1.Broker) *corev1.Volume {
+	v, ok := broker.Annotations[WALAnnotation]
+	if !ok {
+		return nil
+	}
+	switch {
+	case v == "emptyDir":
+		return &corev1.Volume{
+			Name: walVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		}
+	case strings.HasPrefix(v, "pvc:") && len(v) > len("pvc:"):
+		return &corev1.Volume{
+			Name: walVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: strings.TrimPrefix(v, "pvc:"),
+				},
+			},
+		}
+	}
+	return nil
+}
+
+// queueEnv turns the broker queue annotations into dataplane env vars.
+// Invalid values are ignored and the dataplane defaults are used.
+func queueEnv(broker *eventingv1.Broker) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	if v, ok := broker.Annotations[QueueDepthAnnotation]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			env = append(env, corev1.EnvVar{Name: "INGRESS_QUEUE_DEPTH", Value: strconv.Itoa(n)})
+		}
+	}
+	if v, ok := broker.Annotations[QueueMemoryAnnotation]; ok {
+		if q, err := resource.ParseQuantity(v); err == nil && q.Sign() > 0 {
+			env = append(env, corev1.EnvVar{Name: "INGRESS_QUEUE_BYTES", Value: strconv.FormatInt(q.Value(), 10)})
+		}
+	}
+	return env
+}
+
 func MakeService(args *Args) *servingv1.Service {
 	podSpec := makePodSpec(args)
 
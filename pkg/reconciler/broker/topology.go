@@ -0,0 +1,50 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package broker
+
+import (
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/labels"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+	brokerreconciler "knative.dev/eventing/pkg/client/injection/reconciler/eventing/v1/broker"
+	eventinglisters "knative.dev/eventing/pkg/client/listers/eventing/v1"
+	"tableflip.dev/cyanogaster/pkg/topology"
+)
+
+const topologyPath = "/topology"
+
+// topologyHandler serves every GlassBroker in the cluster and its triggers
+// as a graph, in JSON or, with format=dot, DOT.
+func topologyHandler(brokerLister eventinglisters.BrokerLister, triggerLister eventinglisters.TriggerLister) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		brokers, err := brokerLister.List(labels.Everything())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		triggers, err := triggerLister.List(labels.Everything())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		byBroker := make(map[string][]*eventingv1.Trigger)
+		for _, t := range triggers {
+			key := t.Namespace + "/" + t.Spec.Broker
+			byBroker[key] = append(byBroker[key], t)
+		}
+
+		g := topology.New()
+		for _, b := range brokers {
+			if b.Annotations[brokerreconciler.ClassAnnotationKey] != BrokerClass {
+				continue
+			}
+			g.Add(b, byBroker[b.Namespace+"/"+b.Name])
+		}
+		topology.Serve(w, req, g)
+	}
+}
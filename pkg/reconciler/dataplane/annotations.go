@@ -0,0 +1,102 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/types"
+	"golang.org/x/time/rate"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+)
+
+// Trigger annotations understood by the GlassBroker dataplane.
+const (
+	// DeliveryOrderAnnotation set to "ordered" delivers the trigger's events
+	// one at a time, in the order the broker accepted them.
+	DeliveryOrderAnnotation = "glass-broker.tableflip.dev/delivery-order"
+	// OrderingKeyAnnotation names an event extension. For an ordered trigger,
+	// order is then only kept between events with the same value.
+	OrderingKeyAnnotation = "glass-broker.tableflip.dev/ordering-key"
+	// RateLimitAnnotation caps the events per second sent to the subscriber.
+	RateLimitAnnotation = "glass-broker.tableflip.dev/rate-limit"
+	// RateBurstAnnotation is the burst allowed above the rate limit.
+	RateBurstAnnotation = "glass-broker.tableflip.dev/rate-burst"
+	// MaxInFlightAnnotation caps the concurrent requests to the subscriber.
+	MaxInFlightAnnotation = "glass-broker.tableflip.dev/max-in-flight"
+
+	deliveryOrderOrdered = "ordered"
+)
+
+// ordering is how a trigger wants its deliveries sequenced.
+type ordering struct {
+	ordered bool
+	// key is the extension whose value partitions an ordered trigger.
+	key string
+}
+
+func newOrdering(trigger *eventingv1.Trigger) ordering {
+	if !strings.EqualFold(trigger.Annotations[DeliveryOrderAnnotation], deliveryOrderOrdered) {
+		return ordering{}
+	}
+	return ordering{
+		ordered: true,
+		key:     strings.ToLower(trigger.Annotations[OrderingKeyAnnotation]),
+	}
+}
+
+// laneKey is the dispatcher lane event goes to. Unordered triggers and
+// events without the ordering key share a single lane.
+func (o ordering) laneKey(event *cloudevents.Event) string {
+	if !o.ordered || o.key == "" {
+		return ""
+	}
+	v, ok := event.Extensions()[o.key]
+	if !ok {
+		return ""
+	}
+	s, err := types.Format(v)
+	if err != nil {
+		return ""
+	}
+	return s
+}
+
+// limits throttle the deliveries to one trigger's subscriber. Deliveries over
+// a limit wait in the trigger's queue.
+type limits struct {
+	// rate is in events per second, zero is unlimited.
+	rate  rate.Limit
+	burst int
+	// maxInFlight is zero for the dispatcher default.
+	maxInFlight int
+}
+
+// newLimits reads the limit annotations of trigger. Values that do not parse,
+// or are not positive, are ignored.
+func newLimits(trigger *eventingv1.Trigger) limits {
+	var l limits
+	if v, ok := trigger.Annotations[RateLimitAnnotation]; ok {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 {
+			l.rate = rate.Limit(f)
+			l.burst = int(math.Ceil(f))
+		}
+	}
+	if v, ok := trigger.Annotations[RateBurstAnnotation]; ok && l.rate > 0 {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			l.burst = n
+		}
+	}
+	if v, ok := trigger.Annotations[MaxInFlightAnnotation]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			l.maxInFlight = n
+		}
+	}
+	return l
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+	"knative.dev/pkg/system"
+	"tableflip.dev/cyanogaster/pkg/topology"
+)
+
+const (
+	brokerPath   = "/broker"
+	eventsPath   = "/events"
+	statsPath    = "/stats"
+	topologyPath = "/topology"
+
+	defaultListLimit = 100
+)
+
+// listEventsResponse is the body of GET /events.
+type listEventsResponse struct {
+	Events []*historyEntry `json:"events"`
+}
+
+// listEvents serves GET /events. The query may filter on type, source, and
+// since/until as RFC 3339 times, and cap the result with limit.
+func (r *Reconciler) listEvents(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	q := historyQuery{
+		Type:   params.Get("type"),
+		Source: params.Get("source"),
+		Limit:  defaultListLimit,
+	}
+	var err error
+	if v := params.Get("since"); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("until"); v != "" {
+		if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if q.Limit, err = listLimit(params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, listEventsResponse{Events: r.history.List(q)})
+}
+
+// listLimit reads the limit query parameter of a list, defaultListLimit if
+// it is not set.
+func listLimit(params url.Values) (int, error) {
+	v := params.Get("limit")
+	if v == "" {
+		return defaultListLimit, nil
+	}
+	if n, err := strconv.Atoi(v); err == nil && n > 0 {
+		return n, nil
+	}
+	return 0, errors.New("limit must be a positive integer")
+}
+
+// getEvent serves GET /events/{id}, every event with id, newest first. Events
+// from different sources may share an ID, the source query parameter picks
+// one.
+func (r *Reconciler) getEvent(w http.ResponseWriter, req *http.Request, id string) {
+	entries := r.history.List(historyQuery{ID: id, Source: req.URL.Query().Get("source")})
+	if len(entries) == 0 {
+		http.Error(w, "event not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, listEventsResponse{Events: entries})
+}
+
+// routeEvents serves the /events tree.
+func (r *Reconciler) routeEvents(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, eventsPath), "/")
+	if id == "" {
+		r.listEvents(w, req)
+		return
+	}
+	r.getEvent(w, req, id)
+}
+
+// listDeliveriesResponse is the body of GET /deliveries.
+type listDeliveriesResponse struct {
+	Events []*eventTrace `json:"events"`
+}
+
+// routeDeliveries serves the /deliveries tree. GET /deliveries lists the
+// recent delivery records, optionally only those that evaluated the trigger
+// named by the trigger query parameter, and GET /deliveries/{id} returns the
+// record of a single event.
+func (r *Reconciler) routeDeliveries(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, deliveriesPath), "/")
+	if id != "" {
+		t, ok := r.traces.Get(id)
+		if !ok {
+			http.Error(w, "no delivery record for event", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+		return
+	}
+
+	params := req.URL.Query()
+	limit, err := listLimit(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, listDeliveriesResponse{Events: r.traces.List(params.Get("trigger"), limit)})
+}
+
+// statsResponse is the body of GET /stats.
+type statsResponse struct {
+	Queue   queueStats   `json:"queue"`
+	History historyStats `json:"history"`
+	// Dedupe is only set when deduplication is on.
+	Dedupe *dedupeStats `json:"dedupe,omitempty"`
+}
+
+// historyStats is the history section of GET /stats.
+type historyStats struct {
+	Events int   `json:"events"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// serveStats serves GET /stats, the state of the broker's buffers.
+func (r *Reconciler) serveStats(w http.ResponseWriter) {
+	events, bytes := r.history.Len()
+	writeJSON(w, http.StatusOK, statsResponse{
+		Queue:   r.queue.stats(),
+		History: historyStats{Events: events, Bytes: bytes},
+		Dedupe:  r.dedupe.stats(),
+	})
+}
+
+// brokerResponse is the body of GET /broker.
+type brokerResponse struct {
+	Name              string            `json:"name"`
+	Namespace         string            `json:"namespace"`
+	Class             string            `json:"class"`
+	Delivery          map[string]string `json:"delivery,omitempty"`
+	DeadLetterSinkURI string            `json:"deadLetterSinkUri,omitempty"`
+	// Settings are the GlassBroker annotations, without their prefix.
+	Settings map[string]string `json:"settings,omitempty"`
+	Triggers []triggerInfo     `json:"triggers"`
+}
+
+// triggerInfo is a trigger as shown by GET /broker.
+type triggerInfo struct {
+	Name              string            `json:"name"`
+	SubscriberURI     string            `json:"subscriberUri"`
+	Filter            map[string]string `json:"filter,omitempty"`
+	Filters           string            `json:"filters,omitempty"`
+	Delivery          map[string]string `json:"delivery,omitempty"`
+	DeadLetterSinkURI string            `json:"deadLetterSinkUri,omitempty"`
+	Settings          map[string]string `json:"settings,omitempty"`
+	Circuit           string            `json:"circuit"`
+	Counts            deliveryCounts    `json:"counts"`
+}
+
+// serveBroker serves GET /broker, the broker and its triggers as the
+// dataplane sees them.
+func (r *Reconciler) serveBroker(w http.ResponseWriter) {
+	resp := brokerResponse{
+		Name:      r.name,
+		Namespace: system.Namespace(),
+		Class:     r.brokerClass,
+		Triggers:  make([]triggerInfo, 0),
+	}
+
+	r.mux.Lock()
+	b := r.broker
+	triggers := make([]*eventingv1.Trigger, 0, len(r.triggers))
+	for _, t := range r.triggers {
+		triggers = append(triggers, t)
+	}
+	r.mux.Unlock()
+
+	if b != nil {
+		resp.Delivery = topology.DeliveryFields(b.Spec.Delivery)
+		resp.DeadLetterSinkURI = b.Status.DeadLetterSinkURI.String()
+		resp.Settings = topology.Settings(b.Annotations)
+	}
+	sort.Slice(triggers, func(i, j int) bool { return triggers[i].Name < triggers[j].Name })
+	for _, t := range triggers {
+		info := triggerInfo{
+			Name:              t.Name,
+			SubscriberURI:     t.Status.SubscriberURI.String(),
+			Delivery:          topology.DeliveryFields(t.Spec.Delivery),
+			DeadLetterSinkURI: t.Status.DeadLetterSinkURI.String(),
+			Settings:          topology.Settings(t.Annotations),
+			Circuit:           r.breakers.state(t.Status.SubscriberURI.String()).String(),
+			Counts:            r.counts.get(t.Name),
+		}
+		if len(t.Spec.Filters) > 0 {
+			info.Filters = topology.FilterExpression(t.Spec.Filters)
+		} else if t.Spec.Filter != nil {
+			info.Filter = t.Spec.Filter.Attributes
+		}
+		resp.Triggers = append(resp.Triggers, info)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// serveTopology serves GET /topology, this broker and its triggers as a
+// graph in JSON, or DOT with format=dot.
+func (r *Reconciler) serveTopology(w http.ResponseWriter, req *http.Request) {
+	r.mux.Lock()
+	b := r.broker
+	triggers := make([]*eventingv1.Trigger, 0, len(r.triggers))
+	for _, t := range r.triggers {
+		triggers = append(triggers, t)
+	}
+	r.mux.Unlock()
+
+	if b == nil {
+		// Not loaded yet, show the triggers all the same.
+		b = &eventingv1.Broker{}
+		b.Name = r.name
+		b.Namespace = system.Namespace()
+	}
+	g := topology.New()
+	g.Add(b, triggers)
+	topology.Serve(w, req, g)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
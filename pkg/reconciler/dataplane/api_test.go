@@ -0,0 +1,100 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetEventBySourceAndID(t *testing.T) {
+	r := &Reconciler{history: newHistory(10, 0)}
+	now := time.Now()
+	for i, source := range []string{"a", "b"} {
+		event := testEvent()
+		event.SetSource(source)
+		r.history.Add(event, now.Add(time.Duration(i)*time.Second))
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		wantStatus  int
+		wantSources []string
+	}{{
+		name:        "every source",
+		path:        "/events/1",
+		wantStatus:  http.StatusOK,
+		wantSources: []string{"b", "a"},
+	}, {
+		name:        "one source",
+		path:        "/events/1?source=a",
+		wantStatus:  http.StatusOK,
+		wantSources: []string{"a"},
+	}, {
+		name:       "unknown source",
+		path:       "/events/1?source=c",
+		wantStatus: http.StatusNotFound,
+	}, {
+		name:       "unknown id",
+		path:       "/events/2",
+		wantStatus: http.StatusNotFound,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.routeEvents(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tc.wantStatus)
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+			var resp listEventsResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			var sources []string
+			for _, e := range resp.Events {
+				sources = append(sources, e.Event.Source())
+			}
+			if strings.Join(sources, ",") != strings.Join(tc.wantSources, ",") {
+				t.Errorf("sources = %v, want %v", sources, tc.wantSources)
+			}
+		})
+	}
+}
+
+func TestListLimit(t *testing.T) {
+	r := &Reconciler{history: newHistory(10, 0), traces: newTraces(10)}
+	for _, path := range []string{eventsPath, deliveriesPath} {
+		for _, tc := range []struct {
+			limit      string
+			wantStatus int
+		}{
+			{"", http.StatusOK},
+			{"1", http.StatusOK},
+			{"0", http.StatusBadRequest},
+			{"-1", http.StatusBadRequest},
+			{"x", http.StatusBadRequest},
+		} {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, path+"?limit="+tc.limit, nil)
+			if path == eventsPath {
+				r.routeEvents(w, req)
+			} else {
+				r.routeDeliveries(w, req)
+			}
+			if w.Code != tc.wantStatus {
+				t.Errorf("%s with limit %q: status = %d, want %d", path, tc.limit, w.Code, tc.wantStatus)
+			}
+		}
+	}
+}
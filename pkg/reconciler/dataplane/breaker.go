@@ -0,0 +1,223 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+)
+
+// breakerState is the state of a subscriber circuit breaker.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "Closed"
+	case breakerHalfOpen:
+		return "HalfOpen"
+	case breakerOpen:
+		return "Open"
+	}
+	return "Unknown"
+}
+
+// halfOpenPoll is how long deliveries wait while a half-open probe is out.
+const halfOpenPoll = time.Second
+
+// errCircuitOpen is returned by send when the subscriber's circuit breaker
+// refuses a retry.
+var errCircuitOpen = errors.New("subscriber circuit is open")
+
+// breaker is the circuit breaker of one subscriber URI. It opens after a run
+// of consecutive failed attempts, lets a single probe through once the open
+// timeout has passed, and closes again when that probe succeeds.
+type breaker struct {
+	uri         string
+	threshold   int
+	openTimeout time.Duration
+	onChange    func(uri string)
+	now         func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// acquire asks to start a delivery. When the breaker refuses, it returns how
+// long to wait before asking again.
+func (b *breaker) acquire(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if wait := b.openTimeout - now.Sub(b.openedAt); wait > 0 {
+			return false, wait
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true, 0
+	case breakerHalfOpen:
+		if b.probing {
+			return false, halfOpenPoll
+		}
+		b.probing = true
+		return true, 0
+	}
+	return true, 0
+}
+
+// record counts the outcome of one attempt.
+func (b *breaker) record(failed bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures = 0
+		b.probing = false
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	switch b.state {
+	case breakerHalfOpen:
+		b.probing = false
+		b.openedAt = now
+		b.setState(breakerOpen)
+	case breakerClosed:
+		if b.failures >= b.threshold {
+			b.openedAt = now
+			b.setState(breakerOpen)
+		}
+	}
+}
+
+func (b *breaker) current() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// setState moves to s and tells onChange. b.mu must be held.
+func (b *breaker) setState(s breakerState) {
+	b.state = s
+	if b.onChange != nil {
+		// Do not call out under the lock.
+		go b.onChange(b.uri)
+	}
+}
+
+// breakers holds one breaker per subscriber URI. A zero threshold turns
+// circuit breaking off.
+type breakers struct {
+	threshold   int
+	openTimeout time.Duration
+	onChange    func(uri string)
+	// now is the clock the breakers run on.
+	now func() time.Time
+
+	mu sync.Mutex
+	m  map[string]*breaker
+}
+
+func newBreakers(threshold int, openTimeout time.Duration) *breakers {
+	return &breakers{
+		threshold:   threshold,
+		openTimeout: openTimeout,
+		now:         time.Now,
+		m:           make(map[string]*breaker),
+	}
+}
+
+// get returns the breaker for uri, or nil when circuit breaking is off.
+func (bs *breakers) get(uri string) *breaker {
+	if bs == nil || bs.threshold <= 0 {
+		return nil
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.m[uri]
+	if !ok {
+		b = &breaker{
+			uri:         uri,
+			threshold:   bs.threshold,
+			openTimeout: bs.openTimeout,
+			onChange:    bs.onChange,
+			now:         bs.now,
+		}
+		bs.m[uri] = b
+	}
+	return b
+}
+
+// state returns the state of the breaker for uri, closed if it has none.
+func (bs *breakers) state(uri string) breakerState {
+	if bs == nil {
+		return breakerClosed
+	}
+	bs.mu.Lock()
+	b, ok := bs.m[uri]
+	bs.mu.Unlock()
+	if !ok {
+		return breakerClosed
+	}
+	return b.current()
+}
+
+// admitDelivery asks the subscriber's circuit breaker whether d may go out.
+// While the circuit is open, d goes straight to the dead letter sink if the
+// trigger has one, and otherwise waits in the trigger's queue.
+func (r *Reconciler) admitDelivery(d *delivery) (bool, time.Duration) {
+	b := r.breakers.get(d.trigger.Status.SubscriberURI.String())
+	if b == nil {
+		return true, 0
+	}
+	ok, wait := b.acquire(b.now())
+	if ok || d.policy.deadLetterSink == nil {
+		return ok, wait
+	}
+	d.circuitOpen = true
+	return true, 0
+}
+
+// breakerChanged records the new state of the breaker for uri, and has the
+// triggers pointing at uri reconciled so their status shows it.
+func (r *Reconciler) breakerChanged(uri string) {
+	state := r.breakers.state(uri)
+	r.logger.Infow("subscriber circuit breaker changed state", zap.String("subscriber", uri), zap.Stringer("state", state))
+	r.recordBreakerState(uri, state)
+
+	var triggers []*eventingv1.Trigger
+	r.mux.Lock()
+	for _, t := range r.triggers {
+		if t.Status.SubscriberURI.String() == uri {
+			triggers = append(triggers, t)
+		}
+	}
+	r.mux.Unlock()
+	if r.enqueue == nil {
+		return
+	}
+	for _, t := range triggers {
+		r.enqueue(t)
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	eventingduckv1 "knative.dev/eventing/pkg/apis/duck/v1"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+	"knative.dev/pkg/apis"
+	duckv1 "knative.dev/pkg/apis/duck/v1"
+)
+
+const testSubscriber = "http://subscriber.example.com"
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestBreakers(threshold int, openTimeout time.Duration) (*breakers, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	bs := newBreakers(threshold, openTimeout)
+	bs.now = clock.now
+	return bs, clock
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	bs, clock := newTestBreakers(3, 10*time.Second)
+	b := bs.get(testSubscriber)
+
+	type step struct {
+		name string
+		// advance moves the clock before the step.
+		advance time.Duration
+		// acquire asks to start a delivery, record reports one when acquire
+		// is not set.
+		acquire   bool
+		failed    bool
+		wantOK    bool
+		wantWait  time.Duration
+		wantState breakerState
+	}
+	steps := []step{
+		{name: "closed lets deliveries through", acquire: true, wantOK: true, wantState: breakerClosed},
+		{name: "first failure", failed: true, wantState: breakerClosed},
+		{name: "second failure", failed: true, wantState: breakerClosed},
+		{name: "success resets the run", wantState: breakerClosed},
+		{name: "failure 1 of 3", failed: true, wantState: breakerClosed},
+		{name: "failure 2 of 3", failed: true, wantState: breakerClosed},
+		{name: "failure 3 of 3 opens", failed: true, wantState: breakerOpen},
+		{name: "open refuses", advance: 4 * time.Second, acquire: true, wantWait: 6 * time.Second, wantState: breakerOpen},
+		{name: "open timeout lets a probe through", advance: 6 * time.Second, acquire: true, wantOK: true, wantState: breakerHalfOpen},
+		{name: "failed probe opens again", failed: true, wantState: breakerOpen},
+		{name: "open timeout restarts", advance: 5 * time.Second, acquire: true, wantWait: 5 * time.Second, wantState: breakerOpen},
+		{name: "second probe", advance: 5 * time.Second, acquire: true, wantOK: true, wantState: breakerHalfOpen},
+		{name: "successful probe closes", wantState: breakerClosed},
+		{name: "closed after the probe", acquire: true, wantOK: true, wantState: breakerClosed},
+		{name: "failures count from zero", failed: true, wantState: breakerClosed},
+	}
+	for _, s := range steps {
+		clock.advance(s.advance)
+		if s.acquire {
+			ok, wait := b.acquire(clock.now())
+			if ok != s.wantOK || wait != s.wantWait {
+				t.Errorf("%s: acquire() = %v, %v, want %v, %v", s.name, ok, wait, s.wantOK, s.wantWait)
+			}
+		} else {
+			b.record(s.failed, clock.now())
+		}
+		if got := bs.state(testSubscriber); got != s.wantState {
+			t.Errorf("%s: state = %v, want %v", s.name, got, s.wantState)
+		}
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	bs, clock := newTestBreakers(1, time.Second)
+	b := bs.get(testSubscriber)
+	b.record(true, clock.now())
+	clock.advance(time.Second)
+
+	if ok, _ := b.acquire(clock.now()); !ok {
+		t.Fatal("acquire() refused the probe")
+	}
+	// Only the probe is out while half-open, however long it takes.
+	for i := 0; i < 3; i++ {
+		clock.advance(time.Minute)
+		if ok, wait := b.acquire(clock.now()); ok || wait != halfOpenPoll {
+			t.Errorf("acquire() during the probe = %v, %v, want false, %v", ok, wait, halfOpenPoll)
+		}
+	}
+	b.record(false, clock.now())
+	if ok, _ := b.acquire(clock.now()); !ok {
+		t.Error("acquire() refused after the probe succeeded")
+	}
+}
+
+func TestBreakersOff(t *testing.T) {
+	var nilBreakers *breakers
+	for _, bs := range []*breakers{nilBreakers, newBreakers(0, time.Second)} {
+		if b := bs.get(testSubscriber); b != nil {
+			t.Errorf("get() = %v, want nil", b)
+		}
+		if got := bs.state(testSubscriber); got != breakerClosed {
+			t.Errorf("state() = %v, want %v", got, breakerClosed)
+		}
+	}
+}
+
+func TestAdmitDelivery(t *testing.T) {
+	dls, err := apis.ParseURL("http://dls.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name            string
+		open            bool
+		deadLetterSink  *apis.URL
+		wantOK          bool
+		wantWait        time.Duration
+		wantCircuitOpen bool
+	}{{
+		name:   "closed",
+		wantOK: true,
+	}, {
+		name:           "closed with a dead letter sink",
+		deadLetterSink: dls,
+		wantOK:         true,
+	}, {
+		name:     "open holds the delivery",
+		open:     true,
+		wantWait: 10 * time.Second,
+	}, {
+		name:            "open sends to the dead letter sink",
+		open:            true,
+		deadLetterSink:  dls,
+		wantOK:          true,
+		wantCircuitOpen: true,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bs, clock := newTestBreakers(1, 10*time.Second)
+			r := &Reconciler{breakers: bs}
+			if tc.open {
+				bs.get(testSubscriber).record(true, clock.now())
+			}
+
+			uri, err := apis.ParseURL(testSubscriber)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := &delivery{trigger: &eventingv1.Trigger{}}
+			d.trigger.Status.SubscriberURI = uri
+			d.policy.deadLetterSink = tc.deadLetterSink
+
+			ok, wait := r.admitDelivery(d)
+			if ok != tc.wantOK || wait != tc.wantWait {
+				t.Errorf("admitDelivery() = %v, %v, want %v, %v", ok, wait, tc.wantOK, tc.wantWait)
+			}
+			if d.circuitOpen != tc.wantCircuitOpen {
+				t.Errorf("circuitOpen = %v, want %v", d.circuitOpen, tc.wantCircuitOpen)
+			}
+			// Going to the dead letter sink is not a probe.
+			if got := bs.state(testSubscriber); tc.open && got != breakerOpen {
+				t.Errorf("state = %v, want %v", got, breakerOpen)
+			}
+		})
+	}
+}
+
+func TestSendStopsRetryingWhenCircuitOpens(t *testing.T) {
+	var calls int32
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer subscriber.Close()
+
+	bs, _ := newTestBreakers(2, time.Minute)
+	r := &Reconciler{breakers: bs, httpClient: subscriber.Client()}
+	p := deliveryPolicy{retry: 5, backoffPolicy: eventingduckv1.BackoffPolicyLinear, backoffDelay: time.Millisecond}
+
+	res, err := r.send(context.Background(), p, subscriber.URL, testEvent(), bs.get(subscriber.URL))
+	if !errors.Is(err, errCircuitOpen) {
+		t.Errorf("send() = %v, want %v", err, errCircuitOpen)
+	}
+	// The second failure opens the circuit, so there is no third attempt.
+	if got := atomic.LoadInt32(&calls); got != 2 || len(res.attempts) != 2 {
+		t.Errorf("subscriber called %d times, %d attempts, want 2", got, len(res.attempts))
+	}
+}
+
+func TestCircuitOpenDelivery(t *testing.T) {
+	tests := []struct {
+		name      string
+		dlsStatus int
+		want      deliveryCounts
+	}{{
+		name:      "dead letter sink takes it",
+		dlsStatus: http.StatusAccepted,
+		want:      deliveryCounts{CircuitOpen: 1},
+	}, {
+		name:      "dead letter sink fails",
+		dlsStatus: http.StatusInternalServerError,
+		want:      deliveryCounts{Failed: 1},
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dls := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(tc.dlsStatus)
+			}))
+			defer dls.Close()
+
+			trigger := handlerTestTrigger(t, "a", "test.type")
+			trigger.Spec.Delivery = &eventingduckv1.DeliverySpec{DeadLetterSink: &duckv1.Destination{}}
+			trigger.Status.DeadLetterSinkURI, _ = apis.ParseURL(dls.URL)
+			r := newHandlerTestReconciler(t, trigger)
+			r.httpClient = dls.Client()
+
+			d := testDelivery("a", "", limits{})
+			d.ctx = context.Background()
+			d.trigger = trigger
+			d.policy.deadLetterSink = trigger.Status.DeadLetterSinkURI
+			d.circuitOpen = true
+			r.deliver(d)
+
+			if got := r.counts.get("a"); got != tc.want {
+				t.Errorf("counts = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
@@ -13,9 +13,13 @@ import (
 	"knative.dev/pkg/system"
 	"log"
 	"net/http"
+	"os"
 	"sync/atomic"
+	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/client"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
 	"github.com/kelseyhightower/envconfig"
 	"go.uber.org/zap"
 	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
@@ -30,6 +34,47 @@ import (
 
 type envConfig struct {
 	Name string `envconfig:"BROKER_NAME" required:"true"`
+
+	// DeliveryWorkers is the number of deliveries in flight across all triggers.
+	DeliveryWorkers int `envconfig:"DELIVERY_WORKERS" default:"32"`
+	// DeliveryQueueSize is the number of deliveries each trigger may have waiting.
+	DeliveryQueueSize int `envconfig:"DELIVERY_QUEUE_SIZE" default:"1000"`
+	// DeliveryMaxInFlight is the number of deliveries in flight to a single trigger.
+	DeliveryMaxInFlight int `envconfig:"DELIVERY_MAX_IN_FLIGHT" default:"4"`
+	// DeliveryTimeout bounds each attempt when neither the Trigger's nor the
+	// Broker's DeliverySpec sets a timeout.
+	DeliveryTimeout time.Duration `envconfig:"DELIVERY_TIMEOUT" default:"30s"`
+
+	// IngressQueueDepth is the number of accepted events not yet fully delivered.
+	IngressQueueDepth int `envconfig:"INGRESS_QUEUE_DEPTH" default:"10000"`
+	// IngressQueueBytes is the memory budget, in bytes, for those events.
+	IngressQueueBytes int64 `envconfig:"INGRESS_QUEUE_BYTES" default:"67108864"`
+
+	// CircuitBreakerFailures is the run of failed attempts that opens a
+	// subscriber's circuit. Zero turns circuit breaking off.
+	CircuitBreakerFailures int `envconfig:"CIRCUIT_BREAKER_FAILURES" default:"5"`
+	// CircuitBreakerOpenTimeout is how long a circuit stays open before a
+	// probe is let through.
+	CircuitBreakerOpenTimeout time.Duration `envconfig:"CIRCUIT_BREAKER_OPEN_TIMEOUT" default:"30s"`
+
+	// HistorySize is the number of recent events kept for inspection. Zero
+	// turns the history off.
+	HistorySize int `envconfig:"HISTORY_SIZE" default:"1000"`
+	// HistoryBytes is the memory budget, in bytes, for the history.
+	HistoryBytes int64 `envconfig:"HISTORY_BYTES" default:"16777216"`
+
+	// TraceSize is the number of recent events whose delivery record is kept.
+	// Zero turns delivery records off.
+	TraceSize int `envconfig:"TRACE_SIZE" default:"1000"`
+
+	// DedupeWindow is how long the (source, id) of an accepted event is
+	// remembered to drop duplicates at ingress. Zero turns dedupe off.
+	DedupeWindow time.Duration `envconfig:"DEDUPE_WINDOW" default:"0"`
+	// DedupeSize caps how many events the dedupe window remembers.
+	DedupeSize int `envconfig:"DEDUPE_SIZE" default:"100000"`
+
+	// WALDir is where the write-ahead log lives. Empty disables it.
+	WALDir string `envconfig:"WAL_DIR"`
 }
 
 const BrokerClass = "GlassBroker"
@@ -46,34 +91,80 @@ func NewController(
 		log.Fatal("Failed to process env var", zap.Error(err))
 	}
 
+	if err := registerViews(); err != nil {
+		log.Fatal("Failed to register metrics views", zap.Error(err))
+	}
+
 	brokerInformer := brokerinformer.Get(ctx)
 	triggerInformer := triggerinformer.Get(ctx)
 
 	r := &Reconciler{
-		brokerLister: brokerInformer.Lister(),
-		brokerClass:  BrokerClass,
-		name:         env.Name,
-		logger:       logging.FromContext(ctx),
-		isReady:      &atomic.Value{},
-		triggers:     make(map[string]*eventingv1.Trigger),
+		brokerLister:   brokerInformer.Lister(),
+		triggerLister:  triggerInformer.Lister(),
+		triggersSynced: triggerInformer.Informer().HasSynced,
+		brokerClass:    BrokerClass,
+		name:           env.Name,
+		logger:         logging.FromContext(ctx),
+		isReady:        &atomic.Value{},
+		triggers:       make(map[string]*eventingv1.Trigger),
+		filters:        make(map[string]filter),
 	}
 	r.isReady.Store(false)
+	r.queue = newIngressQueue(env.IngressQueueDepth, env.IngressQueueBytes)
+	r.queue.rejected = func(req *http.Request) {
+		// Only binary mode requests carry the type in a header.
+		r.recordIngress(req.Header.Get("Ce-Type"), http.StatusTooManyRequests)
+	}
+	r.history = newHistory(env.HistorySize, env.HistoryBytes)
+	r.tail = newTail()
+	r.traces = newTraces(env.TraceSize)
+	r.dedupe = newDedupe(env.DedupeWindow, env.DedupeSize)
+	r.counts = newTriggerCounts()
+	if env.WALDir != "" {
+		// Each pod keeps its own log, named after the pod.
+		owner, err := os.Hostname()
+		if err != nil {
+			log.Fatal("Failed to get the pod name", zap.Error(err))
+		}
+		w, err := openWAL(env.WALDir, owner)
+		if err != nil {
+			log.Fatal("Failed to open write-ahead log", zap.Error(err))
+		}
+		r.wal = w
+		r.queue.released = r.walDone
+	}
+	r.dispatcher = newDispatcher(env.DeliveryWorkers, env.DeliveryQueueSize, env.DeliveryMaxInFlight, r.deliver)
+	r.dispatcher.admit = r.admitDelivery
+	r.breakers = newBreakers(env.CircuitBreakerFailures, env.CircuitBreakerOpenTimeout)
+	r.breakers.onChange = r.breakerChanged
 
 	logging.FromContext(ctx).Info("Setting up event handlers")
 
-	httpTransport, err := cloudevents.NewHTTP(cloudevents.WithGetHandlerFunc(r.getHandler), cloudevents.WithMiddleware(pkgtracing.HTTPSpanIgnoringPaths(readyz)))
+	httpTransport, err := cloudevents.NewHTTP(
+		cloudevents.WithGetHandlerFunc(r.getHandler),
+		// Middleware added later wraps what came before, so the tracing
+		// middleware runs first and propagateSpan sees its span.
+		cloudevents.WithMiddleware(propagateSpan),
+		cloudevents.WithMiddleware(pkgtracing.HTTPSpanIgnoringPaths(readyz, streamPath)),
+		cloudevents.WithMiddleware(retryAfterOnSaturation),
+		cehttp.WithRateLimiter(r.queue),
+	)
 	if err != nil {
 		log.Fatal("Failed to create cloudevents http protocol", zap.Error(err))
 	}
 	httpTransport.Handler = http.NewServeMux()
 	httpTransport.Handler.HandleFunc(healthz, r.healthZ)
 	httpTransport.Handler.HandleFunc(readyz, r.readyZ)
+	httpTransport.Handler.HandleFunc(streamPath, r.stream)
+	httpTransport.Handler.HandleFunc(replayPath, r.serveReplay)
 
-	ceClient, err := cloudevents.NewClient(httpTransport)
+	ceClient, err := cloudevents.NewClient(httpTransport, client.WithInboundContextDecorator(inboundTraceContext))
 	if err != nil {
 		log.Fatal("Failed to create cloudevents client", zap.Error(err))
 	}
 	r.ceClient = ceClient
+	r.httpClient = &http.Client{}
+	r.deliveryTimeout = env.DeliveryTimeout
 
 	impl := triggerreconciler.NewImpl(ctx, r, func(impl *controller.Impl) controller.Options {
 		return controller.Options{
@@ -96,6 +187,7 @@ func NewController(
 		}
 	})
 	r.uriResolver = resolver.NewURIResolverFromTracker(ctx, impl.Tracker)
+	r.enqueue = impl.Enqueue
 
 	logging.FromContext(ctx).Info("Setting up event handlers")
 
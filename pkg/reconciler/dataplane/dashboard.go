@@ -0,0 +1,76 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	_ "embed"
+	"net/http"
+	"sync"
+)
+
+// dashboardHTML is the dashboard, a single page with no external assets so
+// it works in air-gapped clusters.
+//
+//go:embed dashboard/index.html
+var dashboardHTML []byte
+
+// serveDashboard serves GET /, the dashboard.
+func (r *Reconciler) serveDashboard(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(dashboardHTML)
+}
+
+// deliveryCounts are the delivery results of one trigger since the dataplane
+// started.
+type deliveryCounts struct {
+	Delivered    uint64 `json:"delivered"`
+	DeadLettered uint64 `json:"deadLettered"`
+	Failed       uint64 `json:"failed"`
+	// CircuitOpen are the events sent to the dead letter sink without trying
+	// the subscriber, while its circuit was open.
+	CircuitOpen uint64 `json:"circuitOpen"`
+}
+
+// triggerCounts keeps the deliveryCounts of each trigger.
+type triggerCounts struct {
+	mu sync.Mutex
+	m  map[string]*deliveryCounts
+}
+
+func newTriggerCounts() *triggerCounts {
+	return &triggerCounts{m: make(map[string]*deliveryCounts)}
+}
+
+// add counts one delivery result for trigger.
+func (tc *triggerCounts) add(trigger, result string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	c, ok := tc.m[trigger]
+	if !ok {
+		c = &deliveryCounts{}
+		tc.m[trigger] = c
+	}
+	switch result {
+	case deliveryDelivered:
+		c.Delivered++
+	case deliveryDeadLettered:
+		c.DeadLettered++
+	case deliveryFailed:
+		c.Failed++
+	case deliveryCircuitOpen:
+		c.CircuitOpen++
+	}
+}
+
+func (tc *triggerCounts) get(trigger string) deliveryCounts {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if c, ok := tc.m[trigger]; ok {
+		return *c
+	}
+	return deliveryCounts{}
+}
@@ -0,0 +1,293 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"reflect"
+	"strconv"
+	"strings"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+// FilterDataAnnotation holds conditions on the JSON data of a trigger's
+// events, one per line, that must all hold. A condition is a path, an
+// operator and, for all but exists, a JSON value:
+//
+//	$.tenant == "acme"
+//	/order/region prefix "eu-"
+//	$.items[0].sku exists
+//
+// Paths are JSON Pointers, or JSONPath made only of names and indexes.
+const FilterDataAnnotation = "glass-broker.tableflip.dev/filter-data"
+
+// Data filter operators.
+const (
+	dataOpEquals = "=="
+	dataOpPrefix = "prefix"
+	dataOpExists = "exists"
+)
+
+// filterEvent is an event being matched. Its data is decoded the first time
+// a filter asks for it, and then shared with every other filter. It is not
+// safe for concurrent use.
+type filterEvent struct {
+	*cloudevents.Event
+
+	decoded bool
+	data    interface{}
+	isJSON  bool
+}
+
+func newFilterEvent(event *cloudevents.Event) *filterEvent {
+	return &filterEvent{Event: event}
+}
+
+// jsonData returns the decoded data of the event, and false if it has no
+// JSON data.
+func (e *filterEvent) jsonData() (interface{}, bool) {
+	if e.decoded {
+		return e.data, e.isJSON
+	}
+	e.decoded = true
+	if !isJSONContentType(e.DataContentType()) || len(e.Data()) == 0 {
+		return nil, false
+	}
+	if err := json.Unmarshal(e.Data(), &e.data); err != nil {
+		return nil, false
+	}
+	e.isJSON = true
+	return e.data, true
+}
+
+// isJSONContentType reports whether data of contentType is JSON. Data with no
+// content type is taken to be JSON, as the spec does for structured events,
+// and is only used if it decodes.
+func isJSONContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == "application/json" || mt == "text/json" || strings.HasSuffix(mt, "+json")
+}
+
+// compileDataFilter compiles the conditions of the FilterDataAnnotation.
+func compileDataFilter(conditions string) (filter, error) {
+	var f allFilter
+	for _, line := range strings.Split(conditions, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		c, err := compileDataCondition(line)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", line, err)
+		}
+		f = append(f, c)
+	}
+	if len(f) == 0 {
+		return nil, errors.New("no conditions")
+	}
+	return f, nil
+}
+
+// compileDataCondition compiles one line of the FilterDataAnnotation.
+func compileDataCondition(line string) (filter, error) {
+	path, rest := splitPath(line)
+	op, operand := splitField(rest)
+
+	p, err := compileDataPath(path)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case dataOpExists:
+		if operand != "" {
+			return nil, errors.New("exists takes no value")
+		}
+		return dataFilter{path: p, op: op}, nil
+	case dataOpEquals, dataOpPrefix:
+		var value interface{}
+		if err := json.Unmarshal([]byte(operand), &value); err != nil {
+			return nil, fmt.Errorf("value is not JSON: %w", err)
+		}
+		if _, ok := value.(string); op == dataOpPrefix && !ok {
+			return nil, errors.New("prefix takes a string")
+		}
+		return dataFilter{path: p, op: op, value: value}, nil
+	case "":
+		return nil, errors.New("missing operator")
+	}
+	return nil, fmt.Errorf("unknown operator %q, want one of %s, %s or %s", op, dataOpEquals, dataOpPrefix, dataOpExists)
+}
+
+// splitField splits s at its first run of white space.
+func splitField(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i:])
+	}
+	return s, ""
+}
+
+// splitPath splits s after the path it starts with. White space within the
+// brackets of a JSONPath, as in $['c d'], is part of the path.
+func splitPath(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "$") {
+		return splitField(s)
+	}
+	var quote byte
+	inBrackets := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case inBrackets && (c == '\'' || c == '"'):
+			quote = c
+		case c == '[':
+			inBrackets = true
+		case c == ']':
+			inBrackets = false
+		case !inBrackets && (c == ' ' || c == '\t'):
+			return s[:i], strings.TrimSpace(s[i:])
+		}
+	}
+	return s, ""
+}
+
+// compileDataPath turns a JSON Pointer, or a JSONPath of names and indexes,
+// into the names and indexes to walk from the root of the data.
+func compileDataPath(path string) ([]string, error) {
+	switch {
+	case path == "":
+		return nil, errors.New("missing path")
+	case path[0] == '/':
+		return compileJSONPointer(path), nil
+	case path[0] == '$':
+		return compileJSONPath(path)
+	}
+	return nil, fmt.Errorf("path %q is neither a JSON Pointer nor JSONPath", path)
+}
+
+var jsonPointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// compileJSONPointer splits an RFC 6901 JSON Pointer into its reference
+// tokens.
+func compileJSONPointer(pointer string) []string {
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = jsonPointerUnescaper.Replace(t)
+	}
+	return tokens
+}
+
+// compileJSONPath splits a JSONPath like $.a.b[0]['c d'] into its names and
+// indexes. Wildcards, slices, filters and recursive descent are not
+// supported.
+func compileJSONPath(path string) ([]string, error) {
+	var steps []string
+	s := path[1:]
+	for s != "" {
+		switch s[0] {
+		case '.':
+			end := strings.IndexAny(s[1:], ".[")
+			if end < 0 {
+				end = len(s) - 1
+			}
+			name := s[1 : end+1]
+			if name == "" || name == "*" {
+				return nil, fmt.Errorf("unsupported JSONPath %q", path)
+			}
+			steps = append(steps, name)
+			s = s[end+1:]
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if len(s) > 1 && (s[1] == '\'' || s[1] == '"') {
+				// A quoted name may hold a ], so look past it.
+				end = -1
+				if q := strings.IndexByte(s[2:], s[1]); q >= 0 && q+3 < len(s) && s[q+3] == ']' {
+					end = q + 3
+				}
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in JSONPath %q", path)
+			}
+			sel := s[1:end]
+			if n := len(sel); n >= 2 && (sel[0] == '\'' || sel[0] == '"') && sel[n-1] == sel[0] {
+				steps = append(steps, sel[1:n-1])
+			} else if _, err := strconv.Atoi(sel); err == nil {
+				steps = append(steps, sel)
+			} else {
+				return nil, fmt.Errorf("unsupported JSONPath selector [%s] in %q", sel, path)
+			}
+			s = s[end+1:]
+		default:
+			return nil, fmt.Errorf("unsupported JSONPath %q", path)
+		}
+	}
+	return steps, nil
+}
+
+// dataFilter is one condition on the JSON data of an event. Events without
+// JSON data never match.
+type dataFilter struct {
+	path  []string
+	op    string
+	value interface{}
+}
+
+func (f dataFilter) matches(e *filterEvent) bool {
+	data, ok := e.jsonData()
+	if !ok {
+		return false
+	}
+	v, ok := lookupJSON(data, f.path)
+	if !ok {
+		return false
+	}
+	switch f.op {
+	case dataOpEquals:
+		return reflect.DeepEqual(v, f.value)
+	case dataOpPrefix:
+		s, ok := v.(string)
+		return ok && strings.HasPrefix(s, f.value.(string))
+	}
+	return true
+}
+
+// lookupJSON walks path from the decoded JSON data, and reports whether the
+// value is there. A step into an array is an index.
+func lookupJSON(data interface{}, path []string) (interface{}, bool) {
+	for _, step := range path {
+		switch d := data.(type) {
+		case map[string]interface{}:
+			v, ok := d[step]
+			if !ok {
+				return nil, false
+			}
+			data = v
+		case []interface{}:
+			i, err := strconv.Atoi(step)
+			if err != nil || i < 0 || i >= len(d) || (len(step) > 1 && step[0] == '0') {
+				return nil, false
+			}
+			data = d[i]
+		default:
+			return nil, false
+		}
+	}
+	return data, true
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+)
+
+func TestCompileDataFilter(t *testing.T) {
+	const order = `{"tenant":"acme","order":{"id":42,"region":"eu-west-1","rush":false,"note":null},"items":[{"sku":"a/1"}],"a/b":{"~c":1},"c d":{"e]f":"g h"}}`
+
+	tests := []struct {
+		name        string
+		conditions  string
+		contentType string
+		data        string
+		wantErr     bool
+		want        bool
+	}{{
+		name:       "jsonpath equals",
+		conditions: `$.tenant == "acme"`,
+		want:       true,
+	}, {
+		name:       "jsonpath equals rejects",
+		conditions: `$.tenant == "other"`,
+	}, {
+		name:       "pointer equals number",
+		conditions: `/order/id == 42`,
+		want:       true,
+	}, {
+		name:       "equals compares types",
+		conditions: `/order/id == "42"`,
+	}, {
+		name:       "equals false",
+		conditions: `$.order.rush == false`,
+		want:       true,
+	}, {
+		name:       "equals object",
+		conditions: `$['a/b'] == {"~c": 1}`,
+		want:       true,
+	}, {
+		name:       "prefix",
+		conditions: `$.order.region prefix "eu-"`,
+		want:       true,
+	}, {
+		name:       "prefix of a number never matches",
+		conditions: `/order/id prefix "4"`,
+	}, {
+		name:       "exists",
+		conditions: `$.items[0].sku exists`,
+		want:       true,
+	}, {
+		name:       "exists for null",
+		conditions: `/order/note exists`,
+		want:       true,
+	}, {
+		name:       "missing field",
+		conditions: `$.items[1].sku exists`,
+	}, {
+		name:       "pointer escapes",
+		conditions: `/a~1b/~0c == 1`,
+		want:       true,
+	}, {
+		name:       "bracket names and indexes",
+		conditions: `$["items"][0]['sku'] == "a/1"`,
+		want:       true,
+	}, {
+		name:       "bracket names with spaces",
+		conditions: `$['c d'] exists`,
+		want:       true,
+	}, {
+		name:       "bracket names with spaces and brackets",
+		conditions: `$['c d']["e]f"] == "g h"`,
+		want:       true,
+	}, {
+		name:       "unterminated bracket name",
+		conditions: `$['c d exists`,
+		wantErr:    true,
+	}, {
+		name:       "every condition must hold",
+		conditions: "$.tenant == \"acme\"\n\n  /order/region prefix \"us-\"\n",
+	}, {
+		name:       "value with spaces",
+		conditions: `$.tenant == "acme corp"`,
+	}, {
+		name:        "json with a suffix content type",
+		conditions:  `$.tenant exists`,
+		contentType: "application/vnd.acme+json; charset=utf-8",
+		want:        true,
+	}, {
+		name:        "no content type",
+		conditions:  `$.tenant exists`,
+		contentType: "-",
+		want:        true,
+	}, {
+		name:        "not json",
+		conditions:  `$.tenant exists`,
+		contentType: "text/plain",
+	}, {
+		name:        "malformed json",
+		conditions:  `$.tenant exists`,
+		contentType: cloudevents.ApplicationJSON,
+		data:        `{"tenant":`,
+	}, {
+		name:       "no data",
+		conditions: `$ exists`,
+		data:       "-",
+	}, {
+		name:       "unknown operator",
+		conditions: `$.tenant != "acme"`,
+		wantErr:    true,
+	}, {
+		name:       "missing operator",
+		conditions: `$.tenant`,
+		wantErr:    true,
+	}, {
+		name:       "value is not json",
+		conditions: `$.tenant == acme`,
+		wantErr:    true,
+	}, {
+		name:       "prefix of a number",
+		conditions: `$.tenant prefix 1`,
+		wantErr:    true,
+	}, {
+		name:       "exists with a value",
+		conditions: `$.tenant exists true`,
+		wantErr:    true,
+	}, {
+		name:       "wildcards are not supported",
+		conditions: `$.items[*].sku exists`,
+		wantErr:    true,
+	}, {
+		name:       "not a path",
+		conditions: `data.tenant == "acme"`,
+		wantErr:    true,
+	}, {
+		name:       "no conditions",
+		conditions: " \n ",
+		wantErr:    true,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			trigger := &eventingv1.Trigger{}
+			trigger.Annotations = map[string]string{FilterDataAnnotation: tc.conditions}
+			f, err := compileFilter(trigger)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("compileFilter() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			event := testEvent()
+			data, contentType := order, cloudevents.ApplicationJSON
+			if tc.data != "" {
+				data = tc.data
+			}
+			if tc.contentType != "" {
+				contentType = tc.contentType
+			}
+			if data != "-" {
+				event.DataEncoded = []byte(data)
+			}
+			if contentType != "-" {
+				event.SetDataContentType(contentType)
+			}
+			if got := f.matches(newFilterEvent(&event)); got != tc.want {
+				t.Errorf("matches() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFilterEventDecodesOnce(t *testing.T) {
+	event := testEvent()
+	if err := event.SetData(cloudevents.ApplicationJSON, map[string]string{"tenant": "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	e := newFilterEvent(&event)
+	f, err := compileDataFilter(`$.tenant == "acme"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.matches(e) {
+		t.Fatal("matches() = false, want true")
+	}
+
+	// Later filters see the data as it was first decoded.
+	event.DataEncoded = []byte(`{"tenant":"other"}`)
+	if !f.matches(e) {
+		t.Error("matches() = false after the data changed, want the decoded data reused")
+	}
+}
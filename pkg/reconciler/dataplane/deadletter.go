@@ -0,0 +1,63 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strconv"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap"
+)
+
+// Knative error extensions set on events sent to a dead letter sink.
+const (
+	errorDestExtension = "knativeerrordest"
+	errorCodeExtension = "knativeerrorcode"
+	errorDataExtension = "knativeerrordata"
+)
+
+// deadLetterEvent copies event and adds the Knative error extensions
+// describing why delivery to target failed.
+func deadLetterEvent(event cloudevents.Event, target string, res *dispatchResult) cloudevents.Event {
+	dl := event.Clone()
+	dest := target
+	if u, err := url.Parse(target); err == nil {
+		// Leave out the query, it may carry credentials.
+		dest = (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+	}
+	dl.SetExtension(errorDestExtension, dest)
+	if res.status != 0 {
+		dl.SetExtension(errorCodeExtension, strconv.Itoa(res.status))
+	}
+	if len(res.body) > 0 {
+		dl.SetExtension(errorDataExtension, base64.StdEncoding.EncodeToString(res.body))
+	}
+	return dl
+}
+
+// deadLetter sends a failed delivery to the trigger's dead letter sink,
+// retrying with the trigger's delivery policy. It reports whether the sink
+// took the event.
+func (r *Reconciler) deadLetter(d *delivery, event cloudevents.Event, res *dispatchResult) bool {
+	target := d.trigger.Status.SubscriberURI.URL().String()
+	sink := d.policy.deadLetterSink.URL().String()
+	logger := r.logger.With(
+		zap.String("trigger", d.trigger.Name),
+		zap.String("id", event.ID()),
+		zap.String("deadLetterSink", sink),
+	)
+
+	dlRes, err := r.send(d.ctx, d.policy, sink, deadLetterEvent(event, target, res), nil)
+	r.traceDeadLetter(d, sink, dlRes, err == nil)
+	if err != nil {
+		logger.Errorw("failed to send event to dead letter sink", zap.Any("attempts", dlRes.attempts), zap.Error(err))
+		return false
+	}
+	logger.Debugw("sent event to dead letter sink", zap.Int("status", res.status))
+	return true
+}
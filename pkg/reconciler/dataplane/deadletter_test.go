@@ -0,0 +1,28 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDeadLetterEvent(t *testing.T) {
+	res := &dispatchResult{status: http.StatusServiceUnavailable, body: []byte("down")}
+	dl := deadLetterEvent(testEvent(), "http://subscriber.example.com/path?token=secret", res)
+
+	ext := dl.Extensions()
+	if got := ext[errorDestExtension]; got != "http://subscriber.example.com/path" {
+		t.Errorf("%s = %v, want the target without its query", errorDestExtension, got)
+	}
+	// The Knative spec has the code as a string.
+	if got, ok := ext[errorCodeExtension].(string); !ok || got != "503" {
+		t.Errorf("%s = %#v, want \"503\"", errorCodeExtension, ext[errorCodeExtension])
+	}
+	if got := ext[errorDataExtension]; got != "ZG93bg==" {
+		t.Errorf("%s = %v, want the base64 body", errorDataExtension, got)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// dedupe remembers the (source, id) of recently accepted events so that
+// producers retrying a send do not have the event fanned out twice. Events
+// are remembered for the window, or until size newer ones push them out.
+type dedupe struct {
+	window time.Duration
+	size   int
+
+	mu     sync.Mutex
+	lru    *simplelru.LRU
+	hits   uint64
+	misses uint64
+}
+
+// dedupeStats is the dedupe section of GET /stats.
+type dedupeStats struct {
+	Window  string `json:"window"`
+	Size    int    `json:"size"`
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// newDedupe returns a dedupe window, or nil if window or size is not
+// positive.
+func newDedupe(window time.Duration, size int) *dedupe {
+	if window <= 0 || size <= 0 {
+		return nil
+	}
+	// Only fails for a non-positive size.
+	lru, _ := simplelru.NewLRU(size, nil)
+	return &dedupe{window: window, size: size, lru: lru}
+}
+
+// eventKey identifies event by its source and ID, which together are unique
+// per the CloudEvents spec.
+func eventKey(event *cloudevents.Event) string {
+	return event.Source() + "\x00" + event.ID()
+}
+
+// seen reports whether event was accepted within the window, and remembers
+// it if not.
+func (d *dedupe) seen(event *cloudevents.Event, now time.Time) bool {
+	if d == nil {
+		return false
+	}
+	key := eventKey(event)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if v, ok := d.lru.Peek(key); ok && now.Sub(v.(time.Time)) < d.window {
+		d.hits++
+		return true
+	}
+	d.misses++
+	d.lru.Add(key, now)
+	return false
+}
+
+// forget drops event, for when the broker could not take it after all and
+// the producer should be free to send it again.
+func (d *dedupe) forget(event *cloudevents.Event) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lru.Remove(eventKey(event))
+}
+
+// stats returns the counters, or nil when deduplication is off.
+func (d *dedupe) stats() *dedupeStats {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return &dedupeStats{
+		Window:  d.window.String(),
+		Size:    d.size,
+		Entries: d.lru.Len(),
+		Hits:    d.hits,
+		Misses:  d.misses,
+	}
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"github.com/rickb777/date/period"
+	"go.opencensus.io/trace"
+	eventingduckv1 "knative.dev/eventing/pkg/apis/duck/v1"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+	"knative.dev/pkg/apis"
+)
+
+const (
+	defaultRetry        = 5
+	defaultBackoffDelay = time.Millisecond * 10
+)
+
+// deliveryPolicy is the delivery behaviour for one trigger, after the
+// Trigger's DeliverySpec has been laid over the Broker's.
+type deliveryPolicy struct {
+	// retry is the number of retries after the first attempt; 0 disables retries.
+	retry         int
+	backoffPolicy eventingduckv1.BackoffPolicyType
+	backoffDelay  time.Duration
+	// timeout bounds each attempt; 0 leaves it to the http client.
+	timeout time.Duration
+	// retryAfterMax caps Retry-After; nil is uncapped, 0 ignores the header.
+	retryAfterMax  *time.Duration
+	deadLetterSink *apis.URL
+}
+
+// newDeliveryPolicy resolves the delivery policy of trigger. Each field set
+// on the Trigger's DeliverySpec overrides the same field on the Broker's. The
+// dead letter sink comes from the resolved URIs on the statuses. Attempts are
+// bounded by defaultTimeout when neither DeliverySpec sets a timeout, so a
+// hung subscriber cannot hold a worker forever.
+func newDeliveryPolicy(broker *eventingv1.Broker, trigger *eventingv1.Trigger, defaultTimeout time.Duration) deliveryPolicy {
+	spec := eventingduckv1.DeliverySpec{}
+	var dls *apis.URL
+	if broker != nil {
+		if broker.Spec.Delivery != nil {
+			spec = *broker.Spec.Delivery.DeepCopy()
+		}
+		dls = broker.Status.DeadLetterSinkURI
+	}
+	if trigger.Spec.Delivery != nil {
+		td := trigger.Spec.Delivery
+		if td.Retry != nil {
+			spec.Retry = td.Retry
+		}
+		if td.BackoffPolicy != nil {
+			spec.BackoffPolicy = td.BackoffPolicy
+		}
+		if td.BackoffDelay != nil {
+			spec.BackoffDelay = td.BackoffDelay
+		}
+		if td.Timeout != nil {
+			spec.Timeout = td.Timeout
+		}
+		if td.RetryAfterMax != nil {
+			spec.RetryAfterMax = td.RetryAfterMax
+		}
+		if td.DeadLetterSink != nil {
+			dls = trigger.Status.DeadLetterSinkURI
+		}
+	}
+
+	p := deliveryPolicy{
+		backoffPolicy:  eventingduckv1.BackoffPolicyExponential,
+		backoffDelay:   defaultBackoffDelay,
+		timeout:        defaultTimeout,
+		deadLetterSink: dls,
+	}
+	if spec.Timeout != nil {
+		if d, err := period.Parse(*spec.Timeout); err == nil {
+			p.timeout = d.DurationApprox()
+		}
+	}
+	if spec.RetryAfterMax != nil {
+		if d, err := period.Parse(*spec.RetryAfterMax); err == nil {
+			max := d.DurationApprox()
+			p.retryAfterMax = &max
+		}
+	}
+	if spec.Retry == nil && spec.BackoffPolicy == nil {
+		// No retries asked for.
+		return p
+	}
+	p.retry = defaultRetry
+	if spec.Retry != nil {
+		p.retry = int(*spec.Retry)
+	}
+	if spec.BackoffPolicy != nil {
+		p.backoffPolicy = *spec.BackoffPolicy
+	}
+	if spec.BackoffDelay != nil {
+		if d, err := period.Parse(*spec.BackoffDelay); err == nil {
+			p.backoffDelay = d.DurationApprox()
+		}
+	}
+	return p
+}
+
+// backoff is the delay before the nth retry, counting from 1.
+func (p deliveryPolicy) backoff(n int) time.Duration {
+	if p.backoffPolicy == eventingduckv1.BackoffPolicyLinear {
+		return p.backoffDelay * time.Duration(n)
+	}
+	return p.backoffDelay * time.Duration(math.Exp2(float64(n)))
+}
+
+// attempt records one try at delivering an event, for diagnostics.
+type attempt struct {
+	Target string `json:"target"`
+	// Status is the HTTP status code, or 0 if there was no response.
+	Status   int           `json:"status,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	TimedOut bool          `json:"timedOut,omitempty"`
+	Latency  time.Duration `json:"latency"`
+	// Backoff is how long was waited before this attempt.
+	Backoff time.Duration `json:"backoff,omitempty"`
+}
+
+// maxResponseBody is how much of a subscriber response body is kept.
+const maxResponseBody = 1024
+
+// dispatchResult is the outcome of sending an event, retries included.
+type dispatchResult struct {
+	reply    *cloudevents.Event
+	attempts []attempt
+	// status, header and body are from the last response.
+	status int
+	header http.Header
+	body   []byte
+}
+
+// send delivers event to target, retrying as the policy and the Knative
+// retry rules ask. Each attempt is counted by b, when given, and retries stop
+// with errCircuitOpen once b refuses them.
+func (r *Reconciler) send(ctx context.Context, p deliveryPolicy, target string, event cloudevents.Event, b *breaker) (*dispatchResult, error) {
+	res := &dispatchResult{}
+	var backoff time.Duration
+	for n := 0; ; n++ {
+		if backoff > 0 {
+			select {
+			case <-ctx.Done():
+				return res, ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
+		if n > 0 && b != nil {
+			// The first attempt was let through by admitDelivery.
+			if ok, _ := b.acquire(b.now()); !ok {
+				return res, errCircuitOpen
+			}
+		}
+
+		a, err := r.try(ctx, p, target, event, res)
+		a.Backoff = backoff
+		res.attempts = append(res.attempts, a)
+		if b != nil {
+			// Only failures that say the subscriber is unavailable count.
+			b.record(err != nil && shouldRetry(res.status), b.now())
+		}
+		if err == nil {
+			return res, nil
+		}
+		if n >= p.retry || !shouldRetry(res.status) || ctx.Err() != nil {
+			return res, err
+		}
+		backoff = p.backoff(n + 1)
+		if ra := retryAfter(res.status, res.header, p.retryAfterMax, time.Now()); ra > backoff {
+			backoff = ra
+		}
+	}
+}
+
+// try makes a single attempt, bounded by the policy timeout, and records the
+// response on res.
+func (r *Reconciler) try(ctx context.Context, p deliveryPolicy, target string, event cloudevents.Event, res *dispatchResult) (attempt, error) {
+	res.status, res.header, res.body, res.reply = 0, nil, nil, nil
+
+	// Each attempt is its own span, carried to the target both in the
+	// tracing headers and the event's distributed tracing extension.
+	ctx, span := trace.StartSpan(ctx, dispatchSpanName, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(
+		trace.StringAttribute("http.url", target),
+		trace.StringAttribute("cloudevents.id", event.ID()),
+	)
+	event = event.Clone()
+	setEventSpanContext(&event, span.SpanContext())
+
+	actx := ctx
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		actx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := r.post(actx, target, event, res)
+	a := attempt{Target: target, Status: res.status, Latency: time.Since(start)}
+	if errors.Is(actx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		a.TimedOut = true
+		err = fmt.Errorf("attempt timed out after %s: %w", p.timeout, err)
+	}
+	span.AddAttributes(trace.Int64Attribute("http.status_code", int64(res.status)))
+	if err != nil {
+		a.Error = err.Error()
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: a.Error})
+	}
+	return a, err
+}
+
+// post sends event to target once, and reads the response into res.
+func (r *Reconciler) post(ctx context.Context, target string, event cloudevents.Event, res *dispatchResult) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, nil)
+	if err != nil {
+		return err
+	}
+	if err := cehttp.WriteRequest(ctx, binding.ToMessage(&event), req); err != nil {
+		return err
+	}
+	if span := trace.FromContext(ctx); span != nil {
+		traceFormat.SpanContextToRequest(span.SpanContext(), req)
+	}
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	res.status = resp.StatusCode
+	res.header = resp.Header
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		res.body, _ = io.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+		return fmt.Errorf("%s responded %d", target, resp.StatusCode)
+	}
+
+	msg := cehttp.NewMessageFromHttpResponse(resp)
+	defer msg.Finish(nil)
+	if msg.ReadEncoding() == binding.EncodingUnknown {
+		// No reply.
+		return nil
+	}
+	reply, err := binding.ToEvent(ctx, msg)
+	if err != nil {
+		return fmt.Errorf("malformed reply from %s: %w", target, err)
+	}
+	if err := reply.Validate(); err != nil {
+		return fmt.Errorf("invalid reply from %s: %w", target, err)
+	}
+	res.reply = reply
+	return nil
+}
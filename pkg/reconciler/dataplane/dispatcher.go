@@ -0,0 +1,348 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"golang.org/x/time/rate"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+)
+
+var errQueueFull = errors.New("trigger queue is full")
+
+// delivery is a single event bound for a single trigger.
+type delivery struct {
+	ctx      context.Context
+	env      *envelope
+	event    cloudevents.Event
+	trigger  *eventingv1.Trigger
+	policy   deliveryPolicy
+	ordering ordering
+	limits   limits
+	// circuitOpen is set when the subscriber's circuit breaker refused the
+	// delivery and it goes straight to the dead letter sink.
+	circuitOpen bool
+	// interrupted is set when shutdown cut the delivery short.
+	interrupted bool
+}
+
+// lane is a FIFO of deliveries for one trigger or, for an ordered trigger
+// with an ordering key, for one key of that trigger.
+type lane struct {
+	key      string
+	trigger  *triggerState
+	pending  []*delivery
+	inFlight int
+	// ordered lanes have at most one delivery in flight.
+	ordered bool
+	// queued is true while the lane sits on the dispatcher ready list.
+	queued bool
+}
+
+// triggerState tracks the lanes of one trigger, what it has in flight and
+// its limits.
+type triggerState struct {
+	name     string
+	inFlight int
+	lanes    map[string]*lane
+
+	maxInFlight int
+	limiter     *rate.Limiter
+	// paused is true while the trigger waits for its rate limiter or for
+	// its subscriber's circuit breaker.
+	paused bool
+}
+
+// setLimits applies the latest limits of the trigger. d.mu must be held.
+func (t *triggerState) setLimits(l limits, defaultMaxInFlight int) {
+	t.maxInFlight = defaultMaxInFlight
+	if l.maxInFlight > 0 {
+		t.maxInFlight = l.maxInFlight
+	}
+	switch {
+	case l.rate <= 0:
+		t.limiter = nil
+	case t.limiter == nil:
+		t.limiter = rate.NewLimiter(l.rate, l.burst)
+	case t.limiter.Limit() != l.rate || t.limiter.Burst() != l.burst:
+		t.limiter.SetLimit(l.rate)
+		t.limiter.SetBurst(l.burst)
+	}
+}
+
+// dispatcher is a bounded pool of workers fed by per-trigger queues. Triggers
+// are serviced round-robin and each one is capped at maxInFlight concurrent
+// deliveries, so a slow or hung subscriber can only ever hold a few workers
+// while the rest of the fan-out keeps moving.
+//
+// Ordered triggers get one lane per ordering key, each with at most one
+// delivery in flight, so events sharing a key reach the subscriber in the
+// order they arrived, retries included.
+//
+// A trigger may also carry its own in-flight cap and a token bucket rate
+// limit. A trigger out of tokens is set aside, not holding any worker, until
+// the limiter lets the next delivery through.
+type dispatcher struct {
+	workers     int
+	queueSize   int
+	maxInFlight int
+	deliver     func(*delivery)
+	// admit, if set, is asked before each delivery starts. When it refuses,
+	// the trigger is set aside for the returned duration.
+	admit func(*delivery) (bool, time.Duration)
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	triggers map[string]*triggerState
+	// limiters outlive the state of idle triggers, so a trigger that keeps
+	// its queue empty is still held to its rate. They are dropped with
+	// RemoveTrigger.
+	limiters map[string]*rate.Limiter
+	ready    []*lane
+	closed   bool
+	// fullLanes is the number of lanes holding queueSize deliveries.
+	fullLanes int32
+}
+
+func newDispatcher(workers, queueSize, maxInFlight int, deliver func(*delivery)) *dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	d := &dispatcher{
+		workers:     workers,
+		queueSize:   queueSize,
+		maxInFlight: maxInFlight,
+		deliver:     deliver,
+		triggers:    make(map[string]*triggerState),
+		limiters:    make(map[string]*rate.Limiter),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+// Run starts the workers and blocks until ctx is done. Deliveries still
+// queued at that point are dropped.
+func (d *dispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < d.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.work()
+		}()
+	}
+
+	<-ctx.Done()
+	d.mu.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+	wg.Wait()
+}
+
+// Enqueue adds a delivery to the lane it belongs to.
+func (d *dispatcher) Enqueue(del *delivery) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.triggers[del.trigger.Name]
+	if !ok {
+		t = &triggerState{
+			name:    del.trigger.Name,
+			lanes:   make(map[string]*lane),
+			limiter: d.limiters[del.trigger.Name],
+		}
+		d.triggers[t.name] = t
+	}
+	// The latest delivery wins if the trigger's limits were changed.
+	t.setLimits(del.limits, d.maxInFlight)
+	if t.limiter != nil {
+		d.limiters[t.name] = t.limiter
+	} else {
+		delete(d.limiters, t.name)
+	}
+	key := del.ordering.laneKey(&del.event)
+	l, ok := t.lanes[key]
+	if !ok {
+		l = &lane{key: key, trigger: t}
+		t.lanes[key] = l
+	}
+	if d.queueSize > 0 && len(l.pending) >= d.queueSize {
+		d.forget(l)
+		return errQueueFull
+	}
+	// The latest delivery wins if the trigger's ordering was changed.
+	l.ordered = del.ordering.ordered
+	l.pending = append(l.pending, del)
+	if len(l.pending) == d.queueSize {
+		atomic.AddInt32(&d.fullLanes, 1)
+	}
+	d.schedule(l)
+	return nil
+}
+
+// Backlogged reports whether any lane has no room for another delivery.
+func (d *dispatcher) Backlogged() bool {
+	return d != nil && atomic.LoadInt32(&d.fullLanes) > 0
+}
+
+// Full reports whether the lane of trigger for key has no room for another
+// delivery.
+func (d *dispatcher) Full(trigger, key string) bool {
+	if !d.Backlogged() {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, ok := d.triggers[trigger]
+	if !ok {
+		return false
+	}
+	l, ok := t.lanes[key]
+	return ok && len(l.pending) >= d.queueSize
+}
+
+// RemoveTrigger forgets the rate limiter of a trigger that is gone.
+func (d *dispatcher) RemoveTrigger(name string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.limiters, name)
+}
+
+// schedule puts l on the ready list if it has work and room for another
+// delivery. d.mu must be held.
+func (d *dispatcher) schedule(l *lane) {
+	if l.queued || len(l.pending) == 0 || !d.hasRoom(l) {
+		return
+	}
+	l.queued = true
+	d.ready = append(d.ready, l)
+	d.cond.Signal()
+}
+
+// hasRoom reports whether l may start another delivery. d.mu must be held.
+func (d *dispatcher) hasRoom(l *lane) bool {
+	if l.ordered && l.inFlight > 0 {
+		return false
+	}
+	return !l.trigger.paused && l.trigger.inFlight < l.trigger.maxInFlight
+}
+
+// throttle takes a token from the limiter of t or, when it has none, sets t
+// aside until it has one again and reports that it had to. The returned func
+// gives the token back. d.mu must be held.
+func (d *dispatcher) throttle(t *triggerState) (func(), bool) {
+	if t.limiter == nil {
+		return func() {}, false
+	}
+	now := time.Now()
+	r := t.limiter.ReserveN(now, 1)
+	if wait := r.DelayFrom(now); wait > 0 {
+		r.CancelAt(now)
+		d.pause(t, wait)
+		return nil, true
+	}
+	// Only a cancel at the time of the reservation restores the token.
+	return func() { r.CancelAt(now) }, false
+}
+
+// pause sets t aside, not holding any worker, for wait. d.mu must be held.
+func (d *dispatcher) pause(t *triggerState, wait time.Duration) {
+	t.paused = true
+	time.AfterFunc(wait, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		t.paused = false
+		for _, l := range t.lanes {
+			d.schedule(l)
+		}
+	})
+}
+
+// forget drops l, and its trigger, once they hold nothing. d.mu must be held.
+func (d *dispatcher) forget(l *lane) {
+	if l.inFlight > 0 || len(l.pending) > 0 || l.queued {
+		return
+	}
+	t := l.trigger
+	delete(t.lanes, l.key)
+	if len(t.lanes) == 0 {
+		delete(d.triggers, t.name)
+	}
+}
+
+func (d *dispatcher) work() {
+	for {
+		d.mu.Lock()
+		for len(d.ready) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if d.closed {
+			d.mu.Unlock()
+			return
+		}
+		l := d.ready[0]
+		d.ready[0] = nil
+		d.ready = d.ready[1:]
+		l.queued = false
+		if !d.hasRoom(l) {
+			// Another lane of the trigger took the room since l was queued.
+			// It is scheduled again when a delivery of the trigger finishes.
+			d.mu.Unlock()
+			continue
+		}
+		giveBack, throttled := d.throttle(l.trigger)
+		if throttled {
+			// Scheduled again once the limiter allows.
+			d.mu.Unlock()
+			continue
+		}
+
+		del := l.pending[0]
+		if d.admit != nil {
+			if ok, wait := d.admit(del); !ok {
+				// Nothing went out, so the token is not spent.
+				giveBack()
+				d.pause(l.trigger, wait)
+				d.mu.Unlock()
+				continue
+			}
+		}
+		if len(l.pending) == d.queueSize {
+			atomic.AddInt32(&d.fullLanes, -1)
+		}
+		l.pending[0] = nil
+		l.pending = l.pending[1:]
+		l.inFlight++
+		l.trigger.inFlight++
+		// Go to the back of the line so other triggers get a turn.
+		d.schedule(l)
+		d.mu.Unlock()
+
+		d.deliver(del)
+
+		d.mu.Lock()
+		l.inFlight--
+		l.trigger.inFlight--
+		d.forget(l)
+		for _, other := range l.trigger.lanes {
+			d.schedule(other)
+		}
+		d.mu.Unlock()
+	}
+}
@@ -0,0 +1,347 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+)
+
+func TestDispatcherRateLimitsSteadyTraffic(t *testing.T) {
+	delivered := make(chan time.Time, 10)
+	d := newDispatcher(4, 0, 4, func(del *delivery) {
+		delivered <- time.Now()
+		del.env.done()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	// Each event arrives after the one before was delivered, so the trigger
+	// never has a backlog.
+	const events = 6
+	l := limits{rate: rate.Limit(20), burst: 1}
+	for i := 0; i < events; i++ {
+		if err := d.Enqueue(testDelivery("a", "", l)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var first, last time.Time
+	for i := 0; i < events; i++ {
+		select {
+		case at := <-delivered:
+			if i == 0 {
+				first = at
+			}
+			last = at
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d events delivered", i, events)
+		}
+	}
+	// 20 per second is one every 50ms.
+	if got, want := last.Sub(first), 200*time.Millisecond; got < want {
+		t.Errorf("%d events delivered over %v, want at least %v", events, got, want)
+	}
+}
+
+func TestDispatcherRemoveTriggerDropsLimiter(t *testing.T) {
+	d := newDispatcher(1, 0, 1, func(*delivery) {})
+	if err := d.Enqueue(testDelivery("a", "", limits{rate: 1, burst: 1})); err != nil {
+		t.Fatal(err)
+	}
+	if d.limiters["a"] == nil {
+		t.Fatal("no limiter kept for a")
+	}
+	d.RemoveTrigger("a")
+	if _, ok := d.limiters["a"]; ok {
+		t.Error("limiter kept after RemoveTrigger")
+	}
+}
+
+func TestDispatcherRoundRobin(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	d := newDispatcher(1, 0, 4, func(del *delivery) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, del.trigger.Name)
+	})
+	// A backlog on a does not keep b waiting behind it.
+	for _, name := range []string{"a", "a", "a", "b", "b", "b"} {
+		if err := d.Enqueue(testDelivery(name, "", limits{})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runDispatcher(t, d)
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(order) == 6
+	})
+	if got, want := strings.Join(order, ""), "ababab"; got != want {
+		t.Errorf("delivery order = %s, want %s", got, want)
+	}
+}
+
+func TestDispatcherMaxInFlight(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits limits
+		want   int
+	}{{
+		name: "dispatcher default",
+		want: 2,
+	}, {
+		name:   "trigger limit",
+		limits: limits{maxInFlight: 3},
+		want:   3,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var inFlight, max, done int
+			d := newDispatcher(8, 0, 2, func(*delivery) {
+				mu.Lock()
+				inFlight++
+				if inFlight > max {
+					max = inFlight
+				}
+				mu.Unlock()
+				time.Sleep(20 * time.Millisecond)
+				mu.Lock()
+				inFlight--
+				done++
+				mu.Unlock()
+			})
+			for i := 0; i < 8; i++ {
+				if err := d.Enqueue(testDelivery("a", "", tc.limits)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			runDispatcher(t, d)
+
+			waitFor(t, func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return done == 8
+			})
+			if max != tc.want {
+				t.Errorf("max in flight = %d, want %d", max, tc.want)
+			}
+		})
+	}
+}
+
+func TestDispatcherOrderedLanes(t *testing.T) {
+	type record struct {
+		id  string
+		end time.Time
+	}
+	var mu sync.Mutex
+	inFlight := map[string]int{}
+	records := map[string][]record{}
+	overlap := false
+	d := newDispatcher(4, 0, 4, func(del *delivery) {
+		key := del.event.Extensions()["key"].(string)
+		mu.Lock()
+		inFlight[key]++
+		if inFlight[key] > 1 {
+			overlap = true
+		}
+		mu.Unlock()
+
+		r := record{id: del.event.ID()}
+		if r.id == "1" {
+			// A delivery that is retried holds back the rest of its key.
+			time.Sleep(100 * time.Millisecond)
+		}
+		r.end = time.Now()
+
+		mu.Lock()
+		inFlight[key]--
+		records[key] = append(records[key], r)
+		mu.Unlock()
+	})
+	for i, key := range []string{"k1", "k1", "k2", "k1", "k2"} {
+		del := testDelivery("a", key, limits{})
+		del.event.SetID(string(rune('1' + i)))
+		if err := d.Enqueue(del); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runDispatcher(t, d)
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(records["k1"]) == 3 && len(records["k2"]) == 2
+	})
+	if overlap {
+		t.Error("a key had more than one delivery in flight")
+	}
+	ids := func(rs []record) string {
+		var s string
+		for _, r := range rs {
+			s += r.id
+		}
+		return s
+	}
+	if got := ids(records["k1"]); got != "124" {
+		t.Errorf("k1 delivered %s, want 124", got)
+	}
+	if got := ids(records["k2"]); got != "35" {
+		t.Errorf("k2 delivered %s, want 35", got)
+	}
+	if k1, k2 := records["k1"][0], records["k2"][1]; !k2.end.Before(k1.end) {
+		t.Error("k2 waited for the retries of k1")
+	}
+}
+
+func TestDispatcherQueueFull(t *testing.T) {
+	d := newDispatcher(1, 2, 1, func(*delivery) {})
+	for i := 0; i < 2; i++ {
+		if err := d.Enqueue(testDelivery("a", "", limits{})); err != nil {
+			t.Fatalf("Enqueue() = %v", err)
+		}
+	}
+	if err := d.Enqueue(testDelivery("a", "", limits{})); err != errQueueFull {
+		t.Errorf("Enqueue() = %v, want %v", err, errQueueFull)
+	}
+	// Other triggers have queues of their own.
+	if err := d.Enqueue(testDelivery("b", "", limits{})); err != nil {
+		t.Errorf("Enqueue() = %v", err)
+	}
+}
+
+func TestDispatcherSetsAsideRefusedTriggers(t *testing.T) {
+	tests := []struct {
+		name string
+		// a is refused by the admit hook, or by its rate limiter.
+		admit  bool
+		limits limits
+		want   string
+	}{{
+		name:  "admit refuses",
+		admit: true,
+		want:  "bbaa",
+	}, {
+		// The burst lets the first event through.
+		name:   "rate limited",
+		limits: limits{rate: rate.Limit(10), burst: 1},
+		want:   "abba",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var order []string
+			d := newDispatcher(1, 0, 4, func(del *delivery) {
+				mu.Lock()
+				defer mu.Unlock()
+				order = append(order, del.trigger.Name)
+			})
+			if tc.admit {
+				refused := 0
+				d.admit = func(del *delivery) (bool, time.Duration) {
+					if del.trigger.Name == "a" && refused < 1 {
+						refused++
+						return false, 100 * time.Millisecond
+					}
+					return true, 0
+				}
+			}
+			for _, name := range []string{"a", "a", "b", "b"} {
+				l := limits{}
+				if name == "a" {
+					l = tc.limits
+				}
+				if err := d.Enqueue(testDelivery(name, "", l)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			start := time.Now()
+			runDispatcher(t, d)
+
+			waitFor(t, func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return len(order) == 4
+			})
+			// The single worker is not held while a waits.
+			if got := strings.Join(order, ""); got != tc.want {
+				t.Errorf("delivery order = %s, want %s", got, tc.want)
+			}
+			if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+				t.Errorf("a delivered after %v, want it set aside first", elapsed)
+			}
+		})
+	}
+}
+
+func TestDispatcherKeepsTokensOfRefusedDeliveries(t *testing.T) {
+	delivered := make(chan time.Time, 1)
+	// The burst is one token, and the next one is a minute away.
+	d := newDispatcher(1, 0, 1, func(del *delivery) {
+		delivered <- time.Now()
+	})
+	refused := false
+	d.admit = func(del *delivery) (bool, time.Duration) {
+		if !refused {
+			refused = true
+			return false, 10 * time.Millisecond
+		}
+		return true, 0
+	}
+	if err := d.Enqueue(testDelivery("a", "", limits{rate: rate.Every(time.Minute), burst: 1})); err != nil {
+		t.Fatal(err)
+	}
+	runDispatcher(t, d)
+
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the refused delivery waited for a new token")
+	}
+}
+
+func runDispatcher(t *testing.T, d *dispatcher) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// testDelivery is a delivery of a fresh event to trigger, in the ordering
+// lane of key when key is set.
+func testDelivery(trigger, key string, l limits) *delivery {
+	del := &delivery{
+		env:    &envelope{refs: 1, q: newIngressQueue(1, 0)},
+		event:  testEvent(),
+		limits: l,
+	}
+	del.env.q.events = 1
+	del.trigger = &eventingv1.Trigger{}
+	del.trigger.Name = trigger
+	if key != "" {
+		del.ordering = ordering{ordered: true, key: "key"}
+		del.event.SetExtension("key", key)
+	}
+	return del
+}
@@ -0,0 +1,299 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	cesql "github.com/cloudevents/sdk-go/sql/v2"
+	cesqlparser "github.com/cloudevents/sdk-go/sql/v2/parser"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/types"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+)
+
+// FilterSQLAnnotation is a CloudEvents SQL expression a trigger's events must
+// also satisfy, on top of its filter or filters.
+const FilterSQLAnnotation = "glass-broker.tableflip.dev/filter-sql"
+
+// filter decides whether an event goes to a trigger. Filters are compiled
+// once, when the trigger is reconciled.
+type filter interface {
+	matches(e *filterEvent) bool
+}
+
+// compileFilter compiles the filter of trigger. The Filters field, when set,
+// overrides Filter, as it does on other Knative brokers.
+func compileFilter(trigger *eventingv1.Trigger) (filter, error) {
+	var f allFilter
+	if len(trigger.Spec.Filters) > 0 {
+		for i, sf := range trigger.Spec.Filters {
+			c, err := compileSubscriptionsAPIFilter(sf)
+			if err != nil {
+				return nil, fmt.Errorf("filters[%d]: %w", i, err)
+			}
+			f = append(f, c)
+		}
+	} else if trigger.Spec.Filter != nil && len(trigger.Spec.Filter.Attributes) > 0 {
+		f = append(f, newAttributesFilter(trigger.Spec.Filter.Attributes))
+	}
+
+	if expr, ok := trigger.Annotations[FilterSQLAnnotation]; ok {
+		c, err := compileSQL(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", FilterSQLAnnotation, err)
+		}
+		f = append(f, c)
+	}
+	if conditions, ok := trigger.Annotations[FilterDataAnnotation]; ok {
+		c, err := compileDataFilter(conditions)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", FilterDataAnnotation, err)
+		}
+		f = append(f, c)
+	}
+
+	if len(f) == 1 {
+		return f[0], nil
+	}
+	return f, nil
+}
+
+// compileSubscriptionsAPIFilter compiles one entry of the Filters field, in
+// any of the dialects of the CloudEvents Subscriptions API. An entry with no
+// dialect set matches every event.
+func compileSubscriptionsAPIFilter(sf eventingv1.SubscriptionsAPIFilter) (filter, error) {
+	set := 0
+	for _, ok := range []bool{len(sf.All) > 0, len(sf.Any) > 0, sf.Not != nil, len(sf.Exact) > 0, len(sf.Prefix) > 0, len(sf.Suffix) > 0, sf.CESQL != ""} {
+		if ok {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, errors.New("only one dialect may be set on a filter")
+	}
+
+	switch {
+	case len(sf.All) > 0:
+		f, err := compileSubscriptionsAPIFilters("all", sf.All)
+		return allFilter(f), err
+	case len(sf.Any) > 0:
+		f, err := compileSubscriptionsAPIFilters("any", sf.Any)
+		return anyFilter(f), err
+	case sf.Not != nil:
+		f, err := compileSubscriptionsAPIFilter(*sf.Not)
+		if err != nil {
+			return nil, fmt.Errorf("not: %w", err)
+		}
+		return notFilter{f}, nil
+	case len(sf.Exact) > 0:
+		return compileAttributeFilter("exact", sf.Exact, func(a, v string) filter { return exactFilter{a, v} })
+	case len(sf.Prefix) > 0:
+		return compileAttributeFilter("prefix", sf.Prefix, func(a, v string) filter { return prefixFilter{a, v} })
+	case len(sf.Suffix) > 0:
+		return compileAttributeFilter("suffix", sf.Suffix, func(a, v string) filter { return suffixFilter{a, v} })
+	case sf.CESQL != "":
+		return compileSQL(sf.CESQL)
+	}
+	return allFilter{}, nil
+}
+
+func compileSubscriptionsAPIFilters(dialect string, sfs []eventingv1.SubscriptionsAPIFilter) ([]filter, error) {
+	fs := make([]filter, 0, len(sfs))
+	for i, sf := range sfs {
+		f, err := compileSubscriptionsAPIFilter(sf)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: %w", dialect, i, err)
+		}
+		fs = append(fs, f)
+	}
+	return fs, nil
+}
+
+// compileAttributeFilter checks that an exact, prefix or suffix expression
+// names exactly one attribute, and that neither the name nor the value is
+// empty.
+func compileAttributeFilter(dialect string, m map[string]string, newFilter func(attribute, value string) filter) (filter, error) {
+	if len(m) != 1 {
+		return nil, fmt.Errorf("%s: must have exactly one attribute, has %d", dialect, len(m))
+	}
+	var a, v string
+	for a, v = range m {
+	}
+	if a == "" || v == "" {
+		return nil, fmt.Errorf("%s: attribute and value must not be empty", dialect)
+	}
+	return newFilter(strings.ToLower(a), v), nil
+}
+
+// newAttributesFilter compiles the exact match of the Filter field. Unlike
+// the exact dialect, an empty value is allowed, and matches an attribute that
+// is missing or empty.
+func newAttributesFilter(attributes eventingv1.TriggerFilterAttributes) filter {
+	f := make(allFilter, 0, len(attributes))
+	for a, v := range attributes {
+		f = append(f, exactFilter{attribute: strings.ToLower(a), value: v})
+	}
+	return f
+}
+
+// allFilter matches when each of its filters does, and so always when empty.
+type allFilter []filter
+
+func (f allFilter) matches(e *filterEvent) bool {
+	for _, c := range f {
+		if !c.matches(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// anyFilter matches when at least one of its filters does.
+type anyFilter []filter
+
+func (f anyFilter) matches(e *filterEvent) bool {
+	for _, c := range f {
+		if c.matches(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// notFilter matches when its filter does not.
+type notFilter struct {
+	filter filter
+}
+
+func (f notFilter) matches(e *filterEvent) bool {
+	return !f.filter.matches(e)
+}
+
+// exactFilter matches when an attribute equals value.
+type exactFilter struct {
+	attribute, value string
+}
+
+func (f exactFilter) matches(e *filterEvent) bool {
+	v, _ := lookupAttribute(e.Event, f.attribute)
+	return v == f.value
+}
+
+// prefixFilter matches when an attribute is set and starts with prefix.
+type prefixFilter struct {
+	attribute, prefix string
+}
+
+func (f prefixFilter) matches(e *filterEvent) bool {
+	v, ok := lookupAttribute(e.Event, f.attribute)
+	return ok && strings.HasPrefix(v, f.prefix)
+}
+
+// suffixFilter matches when an attribute is set and ends with suffix.
+type suffixFilter struct {
+	attribute, suffix string
+}
+
+func (f suffixFilter) matches(e *filterEvent) bool {
+	v, ok := lookupAttribute(e.Event, f.attribute)
+	return ok && strings.HasSuffix(v, f.suffix)
+}
+
+// lookupAttribute returns the canonical string form of the attribute name of
+// event, and whether the event has it. Attributes follow the event's spec
+// version: dataschema is a 1.0 attribute, schemaurl and datacontentencoding
+// are 0.3 ones. Optional attributes that are not set are missing, and time is
+// in RFC 3339. Extensions are formatted by their CloudEvents type: decimal
+// integers, true or false, base64 binary and RFC 3339 timestamps.
+//
+// datamediatype, the media type of datacontenttype without parameters, is not
+// a CloudEvents attribute but can be filtered on, as on other Knative brokers.
+func lookupAttribute(event *cloudevents.Event, name string) (string, bool) {
+	v03 := event.SpecVersion() == cloudevents.VersionV03
+	switch name {
+	case "specversion":
+		return event.SpecVersion(), true
+	case "type":
+		return event.Type(), true
+	case "source":
+		return event.Source(), true
+	case "id":
+		return event.ID(), true
+	case "subject":
+		return optionalAttribute(event.Subject())
+	case "time":
+		if event.Time().IsZero() {
+			return "", false
+		}
+		return types.FormatTime(event.Time()), true
+	case "dataschema":
+		if v03 {
+			break
+		}
+		return optionalAttribute(event.DataSchema())
+	case "schemaurl":
+		if !v03 {
+			break
+		}
+		return optionalAttribute(event.DataSchema())
+	case "datacontentencoding":
+		if !v03 {
+			break
+		}
+		return optionalAttribute(event.DeprecatedDataContentEncoding())
+	case "datacontenttype":
+		return optionalAttribute(event.DataContentType())
+	case "datamediatype":
+		return optionalAttribute(event.DataMediaType())
+	}
+
+	v, ok := event.Extensions()[name]
+	if !ok {
+		return "", false
+	}
+	s, err := types.Format(v)
+	if err != nil {
+		// Not a CloudEvents type, so not a valid extension.
+		return "", false
+	}
+	return s, true
+}
+
+func optionalAttribute(v string) (string, bool) {
+	return v, v != ""
+}
+
+// sqlFilter is a CloudEvents SQL expression. It matches when the expression
+// evaluates to true, and not when it fails to evaluate.
+type sqlFilter struct {
+	expr cesql.Expression
+}
+
+func compileSQL(expr string) (f filter, err error) {
+	defer func() {
+		// The parser panics on some malformed expressions.
+		if p := recover(); p != nil {
+			f, err = nil, fmt.Errorf("invalid CloudEvents SQL expression %q: %v", expr, p)
+		}
+	}()
+	e, err := cesqlparser.Parse(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CloudEvents SQL expression %q: %w", expr, err)
+	}
+	return sqlFilter{expr: e}, nil
+}
+
+func (f sqlFilter) matches(e *filterEvent) bool {
+	v, err := f.expr.Evaluate(*e.Event)
+	if err != nil {
+		return false
+	}
+	b, ok := v.(bool)
+	return ok && b
+}
@@ -0,0 +1,369 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/types"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+)
+
+func TestCompileFilterSQL(t *testing.T) {
+	tests := []struct {
+		name       string
+		filters    []eventingv1.SubscriptionsAPIFilter
+		annotation string
+		wantErr    bool
+		want       bool
+	}{{
+		name:    "filters field",
+		filters: []eventingv1.SubscriptionsAPIFilter{{CESQL: "type LIKE 'test.%' AND source != 'x'"}},
+		want:    true,
+	}, {
+		name:    "filters field rejects",
+		filters: []eventingv1.SubscriptionsAPIFilter{{CESQL: "source = 'x'"}},
+	}, {
+		name:       "annotation",
+		annotation: "id = '1'",
+		want:       true,
+	}, {
+		name:       "annotation and filters both apply",
+		filters:    []eventingv1.SubscriptionsAPIFilter{{CESQL: "type = 'test.type'"}},
+		annotation: "id = '2'",
+	}, {
+		name:    "not a boolean",
+		filters: []eventingv1.SubscriptionsAPIFilter{{CESQL: "'yes'"}},
+	}, {
+		name:    "evaluation error",
+		filters: []eventingv1.SubscriptionsAPIFilter{{CESQL: "missing = 'x'"}},
+	}, {
+		name:       "syntax error",
+		annotation: "type = = 'x'",
+		wantErr:    true,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			trigger := &eventingv1.Trigger{}
+			trigger.Spec.Filters = tc.filters
+			if tc.annotation != "" {
+				trigger.Annotations = map[string]string{FilterSQLAnnotation: tc.annotation}
+			}
+			f, err := compileFilter(trigger)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("compileFilter() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			event := testEvent()
+			if got := f.matches(newFilterEvent(&event)); got != tc.want {
+				t.Errorf("matches() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompileFilterDialects(t *testing.T) {
+	type sf = eventingv1.SubscriptionsAPIFilter
+	tests := []struct {
+		name    string
+		filter  sf
+		wantErr bool
+		want    bool
+	}{{
+		name:   "empty matches everything",
+		filter: sf{},
+		want:   true,
+	}, {
+		name:   "exact",
+		filter: sf{Exact: map[string]string{"type": "test.type"}},
+		want:   true,
+	}, {
+		name:   "exact is case sensitive",
+		filter: sf{Exact: map[string]string{"type": "TEST.TYPE"}},
+	}, {
+		name:   "exact extension",
+		filter: sf{Exact: map[string]string{"tenant": "acme"}},
+		want:   true,
+	}, {
+		name:   "exact missing extension",
+		filter: sf{Exact: map[string]string{"region": "eu"}},
+	}, {
+		name:    "exact needs one attribute",
+		filter:  sf{Exact: map[string]string{"type": "test.type", "source": "test"}},
+		wantErr: true,
+	}, {
+		name:    "exact needs a value",
+		filter:  sf{Exact: map[string]string{"type": ""}},
+		wantErr: true,
+	}, {
+		name:   "prefix",
+		filter: sf{Prefix: map[string]string{"type": "test."}},
+		want:   true,
+	}, {
+		name:   "prefix rejects",
+		filter: sf{Prefix: map[string]string{"type": "other."}},
+	}, {
+		name:   "prefix missing extension",
+		filter: sf{Prefix: map[string]string{"region": "e"}},
+	}, {
+		name:    "prefix needs a value",
+		filter:  sf{Prefix: map[string]string{"type": ""}},
+		wantErr: true,
+	}, {
+		name:   "suffix",
+		filter: sf{Suffix: map[string]string{"type": ".type"}},
+		want:   true,
+	}, {
+		name:   "suffix rejects",
+		filter: sf{Suffix: map[string]string{"source": "x"}},
+	}, {
+		name:   "empty suffix is no dialect at all",
+		filter: sf{Suffix: map[string]string{}},
+		want:   true,
+	}, {
+		name: "all",
+		filter: sf{All: []sf{
+			{Exact: map[string]string{"source": "test"}},
+			{Prefix: map[string]string{"type": "test."}},
+		}},
+		want: true,
+	}, {
+		name: "all rejects when one does",
+		filter: sf{All: []sf{
+			{Exact: map[string]string{"source": "test"}},
+			{Prefix: map[string]string{"type": "other."}},
+		}},
+	}, {
+		name: "any",
+		filter: sf{Any: []sf{
+			{Exact: map[string]string{"source": "other"}},
+			{Suffix: map[string]string{"type": ".type"}},
+		}},
+		want: true,
+	}, {
+		name: "any rejects when none do",
+		filter: sf{Any: []sf{
+			{Exact: map[string]string{"source": "other"}},
+			{Suffix: map[string]string{"type": ".other"}},
+		}},
+	}, {
+		name:   "not",
+		filter: sf{Not: &sf{Exact: map[string]string{"source": "other"}}},
+		want:   true,
+	}, {
+		name:   "not rejects",
+		filter: sf{Not: &sf{Exact: map[string]string{"source": "test"}}},
+	}, {
+		name: "nested",
+		filter: sf{Any: []sf{
+			{Not: &sf{Prefix: map[string]string{"type": "test."}}},
+			{All: []sf{
+				{Exact: map[string]string{"tenant": "acme"}},
+				{CESQL: "id = '1'"},
+			}},
+		}},
+		want: true,
+	}, {
+		name: "nested error carries its path",
+		filter: sf{Any: []sf{
+			{Exact: map[string]string{"source": "test"}},
+			{Not: &sf{Exact: map[string]string{"": "x"}}},
+		}},
+		wantErr: true,
+	}, {
+		name: "more than one dialect",
+		filter: sf{
+			Exact:  map[string]string{"source": "test"},
+			Prefix: map[string]string{"type": "test."},
+		},
+		wantErr: true,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			trigger := &eventingv1.Trigger{}
+			trigger.Spec.Filters = []eventingv1.SubscriptionsAPIFilter{tc.filter}
+			f, err := compileFilter(trigger)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("compileFilter() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			event := testEvent()
+			event.SetExtension("tenant", "acme")
+			if got := f.matches(newFilterEvent(&event)); got != tc.want {
+				t.Errorf("matches() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompileFilterAttributes(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes eventingv1.TriggerFilterAttributes
+		want       bool
+	}{{
+		name: "no attributes",
+		want: true,
+	}, {
+		name:       "all equal",
+		attributes: eventingv1.TriggerFilterAttributes{"type": "test.type", "source": "test"},
+		want:       true,
+	}, {
+		name:       "one differs",
+		attributes: eventingv1.TriggerFilterAttributes{"type": "test.type", "source": "other"},
+	}, {
+		name:       "names are case insensitive",
+		attributes: eventingv1.TriggerFilterAttributes{"Type": "test.type"},
+		want:       true,
+	}, {
+		name:       "empty value matches a missing extension",
+		attributes: eventingv1.TriggerFilterAttributes{"region": ""},
+		want:       true,
+	}, {
+		name:       "empty value does not match a set extension",
+		attributes: eventingv1.TriggerFilterAttributes{"tenant": ""},
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			trigger := &eventingv1.Trigger{}
+			trigger.Spec.Filter = &eventingv1.TriggerFilter{Attributes: tc.attributes}
+			f, err := compileFilter(trigger)
+			if err != nil {
+				t.Fatalf("compileFilter() = %v", err)
+			}
+			event := testEvent()
+			event.SetExtension("tenant", "acme")
+			if got := f.matches(newFilterEvent(&event)); got != tc.want {
+				t.Errorf("matches() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLookupAttribute(t *testing.T) {
+	newEvent := func(version string) cloudevents.Event {
+		event := cloudevents.NewEvent(version)
+		event.SetID("1")
+		event.SetType("test.type")
+		event.SetSource("/test")
+		event.SetSubject("sub")
+		event.SetTime(time.Date(2022, 6, 1, 14, 0, 0, 500, time.FixedZone("CEST", 2*60*60)))
+		event.SetDataSchema("https://example.com/schema")
+		event.SetDataContentType("application/json; charset=utf-8")
+		event.SetExtension("str", "acme")
+		event.SetExtension("num", 42)
+		event.SetExtension("yes", true)
+		event.SetExtension("bin", []byte("hi"))
+		event.SetExtension("uri", &url.URL{Scheme: "https", Host: "example.com", Path: "/x"})
+		event.SetExtension("ts", time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC))
+		return event
+	}
+	v1 := newEvent(cloudevents.VersionV1)
+	v03 := newEvent(cloudevents.VersionV03)
+	v03.SetDataContentEncoding(cloudevents.Base64)
+	bare := cloudevents.NewEvent()
+	bare.SetID("1")
+	bare.SetType("test.type")
+	bare.SetSource("/test")
+
+	tests := []struct {
+		name      string
+		event     cloudevents.Event
+		attribute string
+		want      string
+		missing   bool
+	}{
+		{name: "specversion 1.0", event: v1, attribute: "specversion", want: "1.0"},
+		{name: "specversion 0.3", event: v03, attribute: "specversion", want: "0.3"},
+		{name: "id", event: v1, attribute: "id", want: "1"},
+		{name: "type", event: v1, attribute: "type", want: "test.type"},
+		{name: "source", event: v03, attribute: "source", want: "/test"},
+		{name: "subject", event: v1, attribute: "subject", want: "sub"},
+		{name: "subject unset", event: bare, attribute: "subject", missing: true},
+		{name: "time is RFC 3339 in UTC", event: v1, attribute: "time", want: "2022-06-01T12:00:00.0000005Z"},
+		{name: "time 0.3", event: v03, attribute: "time", want: "2022-06-01T12:00:00.0000005Z"},
+		{name: "time unset", event: bare, attribute: "time", missing: true},
+		{name: "dataschema 1.0", event: v1, attribute: "dataschema", want: "https://example.com/schema"},
+		{name: "dataschema is not a 0.3 attribute", event: v03, attribute: "dataschema", missing: true},
+		{name: "schemaurl 0.3", event: v03, attribute: "schemaurl", want: "https://example.com/schema"},
+		{name: "schemaurl is not a 1.0 attribute", event: v1, attribute: "schemaurl", missing: true},
+		{name: "dataschema unset", event: bare, attribute: "dataschema", missing: true},
+		{name: "datacontentencoding 0.3", event: v03, attribute: "datacontentencoding", want: "base64"},
+		{name: "datacontentencoding is not a 1.0 attribute", event: v1, attribute: "datacontentencoding", missing: true},
+		{name: "datacontenttype", event: v1, attribute: "datacontenttype", want: "application/json; charset=utf-8"},
+		{name: "datacontenttype unset", event: bare, attribute: "datacontenttype", missing: true},
+		{name: "datamediatype", event: v03, attribute: "datamediatype", want: "application/json"},
+		{name: "string extension", event: v1, attribute: "str", want: "acme"},
+		{name: "integer extension", event: v1, attribute: "num", want: "42"},
+		{name: "integer extension 0.3", event: v03, attribute: "num", want: "42"},
+		{name: "boolean extension", event: v1, attribute: "yes", want: "true"},
+		{name: "binary extension", event: v1, attribute: "bin", want: "aGk="},
+		{name: "uri extension", event: v1, attribute: "uri", want: "https://example.com/x"},
+		{name: "timestamp extension", event: v1, attribute: "ts", want: "2022-06-01T12:00:00Z"},
+		{name: "missing extension", event: v1, attribute: "other", missing: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := lookupAttribute(&tc.event, tc.attribute)
+			if ok == tc.missing {
+				t.Fatalf("lookupAttribute(%q) present = %v, want %v", tc.attribute, ok, !tc.missing)
+			}
+			if got != tc.want {
+				t.Errorf("lookupAttribute(%q) = %q, want %q", tc.attribute, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFilterCanonicalAttributes(t *testing.T) {
+	event := testEvent()
+	event.SetTime(time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC))
+	event.SetExtension("num", 42)
+	event.SetExtension("ts", types.Timestamp{Time: time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)})
+
+	tests := []struct {
+		name   string
+		filter eventingv1.SubscriptionsAPIFilter
+		want   bool
+	}{{
+		name:   "time",
+		filter: eventingv1.SubscriptionsAPIFilter{Exact: map[string]string{"time": "2022-06-01T12:00:00Z"}},
+		want:   true,
+	}, {
+		name:   "time by date",
+		filter: eventingv1.SubscriptionsAPIFilter{Prefix: map[string]string{"time": "2022-06-01T"}},
+		want:   true,
+	}, {
+		name:   "integer extension",
+		filter: eventingv1.SubscriptionsAPIFilter{Exact: map[string]string{"num": "42"}},
+		want:   true,
+	}, {
+		name:   "timestamp extension",
+		filter: eventingv1.SubscriptionsAPIFilter{Suffix: map[string]string{"ts": "12:00:00Z"}},
+		want:   true,
+	}, {
+		name:   "unset dataschema",
+		filter: eventingv1.SubscriptionsAPIFilter{Prefix: map[string]string{"dataschema": "h"}},
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := compileSubscriptionsAPIFilter(tc.filter)
+			if err != nil {
+				t.Fatalf("compileSubscriptionsAPIFilter() = %v", err)
+			}
+			if got := f.matches(newFilterEvent(&event)); got != tc.want {
+				t.Errorf("matches() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -8,20 +8,14 @@ package dataplane
 import (
 	"context"
 	"errors"
-	"github.com/cloudevents/sdk-go/v2/protocol/gochan"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
-	"github.com/cloudevents/sdk-go/v2/types"
-	"github.com/rickb777/date/period"
 	"go.opencensus.io/trace"
 	"go.uber.org/zap"
-	eventingduckv1 "knative.dev/eventing/pkg/apis/duck/v1"
-	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
-	"knative.dev/pkg/logging"
+	"knative.dev/eventing/pkg/broker"
 )
 
 const (
@@ -57,19 +51,15 @@ func (r *Reconciler) Start(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	ce, err := cloudevents.NewClient(gochan.New())
-	if err != nil {
-		log.Fatalf("failed to create client: %v", err)
-	}
-	r.ceChan = ce
-
 	errCh := make(chan error, 1)
 	go func() {
 		errCh <- r.ceClient.StartReceiver(ctx, r.ingress)
 	}()
-	go func() {
-		errCh <- r.ceChan.StartReceiver(ctx, r.receiver)
-	}()
+	go r.queue.Run(ctx, r.receiver)
+	go r.dispatcher.Run(ctx)
+	if r.wal != nil {
+		go r.replay(ctx)
+	}
 
 	// We are ready.
 	r.isReady.Store(true)
@@ -85,6 +75,12 @@ func (r *Reconciler) Start(ctx context.Context) error {
 	// No longer ready.
 	r.isReady.Store(false)
 
+	if r.wal != nil {
+		defer r.wal.Close()
+	}
+	// Streams do not end on their own, so the server could not shut down.
+	r.tail.Close()
+
 	// stopCh has been closed, we need to gracefully shutdown h.ceClient. cancel() will start its
 	// shutdown, if it hasn't finished in a reasonable amount of time, just return an error.
 	cancel()
@@ -96,123 +92,223 @@ func (r *Reconciler) Start(ctx context.Context) error {
 	}
 }
 
+// getHandler serves the GET requests that reach the cloudevents receiver,
+// the dashboard and the inspection API behind it.
 func (r *Reconciler) getHandler(resp http.ResponseWriter, req *http.Request) {
-	_, _ = resp.Write([]byte("hello"))
+	switch {
+	case req.URL.Path == "/":
+		r.serveDashboard(resp)
+	case req.URL.Path == brokerPath:
+		r.serveBroker(resp)
+	case req.URL.Path == eventsPath || strings.HasPrefix(req.URL.Path, eventsPath+"/"):
+		r.routeEvents(resp, req)
+	case req.URL.Path == deliveriesPath || strings.HasPrefix(req.URL.Path, deliveriesPath+"/"):
+		r.routeDeliveries(resp, req)
+	case req.URL.Path == statsPath:
+		r.serveStats(resp)
+	case req.URL.Path == topologyPath:
+		r.serveTopology(resp, req)
+	default:
+		http.NotFound(resp, req)
+	}
 }
 
 func (r *Reconciler) ingress(ctx context.Context, event cloudevents.Event) error {
-	r.logger.Infof("%s", event)
-	if result := r.ceChan.Send(ctx, event); cloudevents.IsUndelivered(result) {
-		r.logger.Errorw("failed to send event", zap.Error(result))
-		return cloudevents.NewHTTPResult(500, "unable to ingress")
+	defaultEventTTL(&event)
+	ctx, span := startEventSpan(ctx, ingressSpanName, &event)
+	defer span.End()
+	if r.dedupe.seen(&event, time.Now()) {
+		// Acknowledge, the producer is retrying one we already have.
+		r.logger.Debugw("dropping duplicate event", zap.String("source", event.Source()), zap.String("id", event.ID()))
+		r.recordDedupeHit()
+		r.recordIngress(event.Type(), http.StatusOK)
+		return nil
+	}
+	if err := r.accept(ctx, event); errors.Is(err, errSaturated) {
+		r.dedupe.forget(&event)
+		r.logger.Warnw("broker is saturated, rejecting event", zap.String("id", event.ID()))
+		r.recordIngress(event.Type(), http.StatusTooManyRequests)
+		return cloudevents.NewHTTPResult(http.StatusTooManyRequests, "broker is saturated")
+	} else if err != nil {
+		r.dedupe.forget(&event)
+		r.logger.Errorw("failed to accept event", zap.String("id", event.ID()), zap.Error(err))
+		r.recordIngress(event.Type(), http.StatusInternalServerError)
+		return cloudevents.NewHTTPResult(http.StatusInternalServerError, "unable to ingress")
 	}
+	r.recordIngress(event.Type(), http.StatusOK)
 	return nil
 }
 
-// sendEvent sends an event to a subscriber if the trigger filter passes.
-func (r *Reconciler) receiver(ctx context.Context, event cloudevents.Event) error {
-	r.logger.Infof("%s", event)
+// accept takes event into the broker and queues it for fan-out, keeping it in
+// the history.
+func (r *Reconciler) accept(ctx context.Context, event cloudevents.Event) error {
+	env, err := r.admit(ctx, event)
+	if err != nil {
+		return err
+	}
+	r.queue.Push(env)
+	r.history.Add(event, time.Now())
+	r.tailEvent(event)
+	return nil
+}
 
-	if r.broker != nil && r.broker.Spec.Delivery != nil && r.broker.Spec.Delivery.BackoffPolicy != nil {
-		retry := 5
-		if r.broker.Spec.Delivery.Retry != nil {
-			retry = int(*r.broker.Spec.Delivery.Retry)
-		}
-		backoff := time.Millisecond * 10
-		if r.broker.Spec.Delivery.BackoffDelay != nil {
-			p, _ := period.Parse(*r.broker.Spec.Delivery.BackoffDelay)
-			backoff = p.DurationApprox()
+// admit takes event into the broker, recording it in the write-ahead log
+// when there is one. A broker with a trigger queue too full to take the event
+// is saturated.
+func (r *Reconciler) admit(ctx context.Context, event cloudevents.Event) (*envelope, error) {
+	if r.backlogged(&event, "") {
+		return nil, errSaturated
+	}
+	env := r.queue.Admit(ctx, event)
+	if env == nil {
+		return nil, errSaturated
+	}
+	if r.wal != nil {
+		seq, err := r.wal.Append(event)
+		if err != nil {
+			env.done()
+			return nil, err
 		}
+		env.seq = seq
+	}
+	return env, nil
+}
+
+// receiver fans an accepted event out to the triggers whose filter passes.
+func (r *Reconciler) receiver(ctx context.Context, env *envelope) {
+	// Release the fan-out reference once every delivery is queued.
+	defer env.done()
+
+	event := env.event
 
-		if *r.broker.Spec.Delivery.BackoffPolicy == eventingduckv1.BackoffPolicyLinear {
-			ctx = cloudevents.ContextWithRetriesLinearBackoff(ctx, backoff, retry)
-		} else {
-			ctx = cloudevents.ContextWithRetriesExponentialBackoff(ctx, backoff, retry)
+	// Match against the current snapshot of the triggers.
+	x := r.triggerIndex()
+	b := x.broker
+	evaluated, triggers := x.match(&event, env.only, env.acked)
+	r.traces.evaluated(&event, env.only, time.Now(), evaluated, triggers)
+
+	// Then hand each matching trigger its own delivery.
+	env.hold(len(triggers))
+	for _, trigger := range triggers {
+		d := &delivery{
+			ctx:      trace.NewContext(ctx, env.span),
+			env:      env,
+			event:    event,
+			trigger:  trigger,
+			policy:   newDeliveryPolicy(b, trigger, r.deliveryTimeout),
+			ordering: newOrdering(trigger),
+			limits:   newLimits(trigger),
+		}
+		if err := r.dispatcher.Enqueue(d); err != nil {
+			// Off the fan-out, the dead letter sink may be slow.
+			go r.overflow(d, err)
 		}
 	}
+}
 
-	// Quickly collect the current matching triggers.
-	var triggers []*eventingv1.Trigger
-	r.mux.Lock()
-	r.logger.Info("Triggers:", len(r.triggers))
-	for _, trigger := range r.triggers {
-		if eventMatchesFilter(ctx, &event, trigger.Spec.Filter.Attributes) {
-			r.logger.Infof("matched! [%s] -> %s", event.ID(), trigger.Status.SubscriberURI.URL().String())
-			triggers = append(triggers, trigger)
-		} else {
-			r.logger.Infof("no match. [%s]", event.ID())
+// backlogged reports whether a trigger event goes to, only that trigger when
+// only is set, has its queue full. Ingress pushes back on such events rather
+// than have them overflow the queue.
+func (r *Reconciler) backlogged(event *cloudevents.Event, only string) bool {
+	if !r.dispatcher.Backlogged() {
+		return false
+	}
+	_, triggers := r.triggerIndex().match(event, only, nil)
+	for _, t := range triggers {
+		if r.dispatcher.Full(t.Name, newOrdering(t).laneKey(event)) {
+			return true
 		}
 	}
-	r.mux.Unlock()
+	return false
+}
 
-	// Then process the matching triggers one at a time.
-	for _, trigger := range triggers {
-		// TODO: this could be go routines and a worker pool here to not let a single trigger block the others.
-		sendingCTX := cloudevents.ContextWithTarget(ctx, trigger.Status.SubscriberURI.URL().String())
-		sendingCTX = trace.NewContext(sendingCTX, trace.FromContext(ctx))
-
-		if reply, result := r.ceClient.Request(sendingCTX, event); cloudevents.IsUndelivered(result) {
-			r.logger.Errorw("failed to send event", zap.Error(result))
-
-			// DLQ
-			if r.broker.Status.DeadLetterSinkURI != nil {
-				go func() {
-					dlqCTX := cloudevents.ContextWithTarget(ctx, r.broker.Status.DeadLetterSinkURI.URL().String())
-					if result := r.ceClient.Send(dlqCTX, event); cloudevents.IsUndelivered(result) {
-						r.logger.Errorw("failed to dql", zap.Error(result))
-					}
-				}()
-			}
-			// TODO: DLQ overrides from trigger.
-
-		} else if reply != nil {
-			// OMG so much yolo...
-			go func() {
-				sendingCTX := cloudevents.ContextWithTarget(ctx, "http://loalhost:8080") // TODO should be this ingress?
-				sendingCTX = trace.NewContext(sendingCTX, trace.FromContext(ctx))
-				if result := r.ceClient.Send(sendingCTX, *reply); cloudevents.IsUndelivered(result) {
-					r.logger.Errorw("failed to send reply", zap.Error(result))
-				}
-			}()
+// overflow settles d when its trigger's queue had no room for it, which
+// ingress backpressure leaves to races and replays. It goes to the dead letter
+// sink if the trigger has one. Otherwise it failed, and it is left unfinished
+// in the write-ahead log so the next run delivers it again.
+func (r *Reconciler) overflow(d *delivery, err error) {
+	defer d.env.done()
+	r.logger.Errorw("failed to enqueue event", zap.String("trigger", d.trigger.Name), zap.String("id", d.event.ID()), zap.Error(err))
+
+	event := d.event.Clone()
+	_ = broker.DeleteTTL(event.Context)
+	if d.policy.deadLetterSink != nil && r.deadLetter(d, event, &dispatchResult{}) {
+		r.walAck(d)
+		r.delivered(d, deliveryDeadLettered, nil, err)
+		return
+	}
+	d.env.interrupt()
+	r.delivered(d, deliveryFailed, nil, err)
+}
+
+// deliver sends one event to one trigger subscriber. It is called from the
+// dispatcher workers.
+func (r *Reconciler) deliver(d *delivery) {
+	defer d.env.done()
+	defer r.walAck(d)
+	if r.interrupted(d) {
+		// Dequeued as the broker shut down.
+		return
+	}
+
+	// The TTL is broker bookkeeping, subscribers do not see it.
+	event := d.event.Clone()
+	_ = broker.DeleteTTL(event.Context)
+
+	target := d.trigger.Status.SubscriberURI.URL().String()
+	if d.circuitOpen {
+		r.logger.Warnw("subscriber circuit is open, skipping delivery",
+			zap.String("trigger", d.trigger.Name),
+			zap.String("id", event.ID()))
+		r.failed(d, event, &dispatchResult{}, errCircuitOpen)
+		return
+	}
+
+	res, err := r.send(d.ctx, d.policy, target, event, r.breakers.get(target))
+	if err != nil {
+		if r.interrupted(d) {
+			// Not the subscriber's doing, leave it for the next run.
+			return
 		}
+		r.logger.Errorw("failed to send event",
+			zap.String("trigger", d.trigger.Name),
+			zap.String("id", event.ID()),
+			zap.Any("attempts", res.attempts),
+			zap.Error(err))
+		r.failed(d, event, res, err)
+		return
+	}
+	r.delivered(d, deliveryDelivered, res, nil)
+	if res.reply != nil {
+		r.reply(d.ctx, d, *res.reply)
 	}
-	return nil
 }
 
-func eventMatchesFilter(ctx context.Context, event *cloudevents.Event, attributesFilter eventingv1.TriggerFilterAttributes) bool {
-	for a, v := range attributesFilter {
-		a = strings.ToLower(a)
-		logging.FromContext(ctx).Info("filtering on", a)
-		// Find the value.
-		var ev string
-		switch a {
-		case "specversion":
-			ev = event.SpecVersion()
-		case "type":
-			ev = event.Type()
-		case "source":
-			ev = event.Source()
-		case "subject":
-			ev = event.Subject()
-		case "id":
-			ev = event.ID()
-		case "time":
-			ev = event.Time().String()
-		case "schemaurl":
-			ev = event.DataSchema()
-		case "datacontenttype":
-			ev = event.DataContentType()
-		case "datamediatype":
-			ev = event.DataMediaType()
-		default:
-			if exv, ok := event.Extensions()[a]; ok {
-				ev, _ = types.ToString(exv)
+// failed sends d to the dead letter sink, when the trigger has one, after
+// delivering its event failed with err, and records the outcome.
+func (r *Reconciler) failed(d *delivery, event cloudevents.Event, res *dispatchResult, err error) {
+	result := deliveryFailed
+	if d.policy.deadLetterSink != nil {
+		if r.deadLetter(d, event, res) {
+			result = deliveryDeadLettered
+			if errors.Is(err, errCircuitOpen) {
+				result = deliveryCircuitOpen
 			}
+		} else if r.interrupted(d) {
+			return
 		}
-		// Compare
-		if v != ev {
-			return false
-		}
 	}
-	return true
+	r.delivered(d, result, res, err)
+}
+
+// delivered records the outcome of d for the metrics, the trace and the tail.
+func (r *Reconciler) delivered(d *delivery, result string, res *dispatchResult, err error) {
+	var attempts []attempt
+	if res != nil {
+		attempts = res.attempts
+	}
+	r.recordDispatch(d, attempts)
+	r.counts.add(d.trigger.Name, result)
+	r.traceDelivery(d, result, res, err)
+	r.tailDelivery(d, result, res)
 }
@@ -0,0 +1,171 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"go.uber.org/zap"
+	eventingduckv1 "knative.dev/eventing/pkg/apis/duck/v1"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+	"knative.dev/pkg/apis"
+	duckv1 "knative.dev/pkg/apis/duck/v1"
+)
+
+func TestIngressPushesBackOnFullTriggerQueue(t *testing.T) {
+	t.Setenv("SYSTEM_NAMESPACE", testNamespace)
+	throttled := handlerTestTrigger(t, "throttled", "test.type")
+	throttled.Annotations = map[string]string{RateLimitAnnotation: "0.001"}
+	r := newHandlerTestReconciler(t, throttled, handlerTestTrigger(t, "other", "other.type"))
+	delivered := make(chan string, 10)
+	r.dispatcher = newDispatcher(2, 2, 4, func(d *delivery) {
+		delivered <- d.event.ID()
+		d.env.done()
+	})
+	runDispatcher(t, r.dispatcher)
+	ctx := context.Background()
+
+	// The burst lets the first event through.
+	if err := ingressAndFanOut(ctx, r, "1", "test.type"); err != nil {
+		t.Fatalf("ingress() = %v", err)
+	}
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first event was not delivered")
+	}
+	// The next two wait for the limiter, and fill the trigger queue.
+	for _, id := range []string{"2", "3"} {
+		if err := ingressAndFanOut(ctx, r, id, "test.type"); err != nil {
+			t.Fatalf("ingress(%s) = %v", id, err)
+		}
+	}
+
+	err := ingressAndFanOut(ctx, r, "4", "test.type")
+	var res *cehttp.Result
+	if !errors.As(err, &res) || res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("ingress() past the trigger queue = %v, want 429", err)
+	}
+	// Other triggers still take events.
+	if err := ingressAndFanOut(ctx, r, "5", "other.type"); err != nil {
+		t.Errorf("ingress() for another trigger = %v", err)
+	}
+	if c := r.counts.get("throttled"); c.Failed != 0 {
+		t.Errorf("failed = %d, want none", c.Failed)
+	}
+}
+
+func TestOverflowedDelivery(t *testing.T) {
+	tests := []struct {
+		name           string
+		deadLetterSink bool
+		want           deliveryCounts
+		wantUnfinished bool
+	}{{
+		name:           "no dead letter sink",
+		want:           deliveryCounts{Failed: 1},
+		wantUnfinished: true,
+	}, {
+		name:           "dead letter sink",
+		deadLetterSink: true,
+		want:           deliveryCounts{DeadLettered: 1},
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sink := make(chan struct{}, 1)
+			dls := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				sink <- struct{}{}
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			defer dls.Close()
+
+			trigger := handlerTestTrigger(t, "a", "test.type")
+			if tc.deadLetterSink {
+				trigger.Spec.Delivery = &eventingduckv1.DeliverySpec{DeadLetterSink: &duckv1.Destination{}}
+				trigger.Status.DeadLetterSinkURI, _ = apis.ParseURL(dls.URL)
+			}
+			r := newHandlerTestReconciler(t, trigger)
+			r.httpClient = dls.Client()
+			// The trigger queue is already full, as when a burst races ingress.
+			r.dispatcher = newDispatcher(1, 1, 1, func(*delivery) {})
+			if err := r.dispatcher.Enqueue(testDelivery("a", "", limits{})); err != nil {
+				t.Fatal(err)
+			}
+
+			env := r.queue.Admit(context.Background(), testEvent())
+			r.receiver(context.Background(), env)
+			waitFor(t, func() bool { return r.queue.stats().Events == 0 })
+
+			if got := r.counts.get("a"); got != tc.want {
+				t.Errorf("counts = %+v, want %+v", got, tc.want)
+			}
+			if got := env.wasInterrupted(); got != tc.wantUnfinished {
+				t.Errorf("left unfinished = %v, want %v", got, tc.wantUnfinished)
+			}
+			if tc.deadLetterSink && len(sink) != 1 {
+				t.Error("event was not sent to the dead letter sink")
+			}
+		})
+	}
+}
+
+// ingressAndFanOut sends an event of type with id to the broker, and fans it
+// out once accepted.
+func ingressAndFanOut(ctx context.Context, r *Reconciler, id, typ string) error {
+	event := testEvent()
+	event.SetID(id)
+	event.SetType(typ)
+	if err := r.ingress(ctx, event); err != nil {
+		return err
+	}
+	r.receiver(ctx, <-r.queue.ch)
+	return nil
+}
+
+// handlerTestTrigger is a ready trigger for events of typ.
+func handlerTestTrigger(t *testing.T, name, typ string) *eventingv1.Trigger {
+	trigger := &eventingv1.Trigger{}
+	trigger.Name = name
+	trigger.Namespace = testNamespace
+	trigger.Spec.Filter = &eventingv1.TriggerFilter{Attributes: eventingv1.TriggerFilterAttributes{"type": typ}}
+	trigger.Status.Conditions = duckv1.Conditions{{Type: apis.ConditionReady, Status: "True"}}
+	uri, err := apis.ParseURL("http://" + name + ".example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trigger.Status.SubscriberURI = uri
+	return trigger
+}
+
+// newHandlerTestReconciler has triggers loaded, and no dispatcher.
+func newHandlerTestReconciler(t *testing.T, triggers ...*eventingv1.Trigger) *Reconciler {
+	r := &Reconciler{
+		name:       "default",
+		logger:     zap.NewNop().Sugar(),
+		triggers:   make(map[string]*eventingv1.Trigger),
+		filters:    make(map[string]filter),
+		queue:      newIngressQueue(100, 0),
+		tail:       newTail(),
+		counts:     newTriggerCounts(),
+		httpClient: http.DefaultClient,
+	}
+	for _, trigger := range triggers {
+		f, err := compileFilter(trigger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.triggers[trigger.Name] = trigger
+		r.filters[trigger.Name] = f
+	}
+	r.reindex()
+	return r
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// historyEntry is an event the broker accepted, as kept in the history.
+type historyEntry struct {
+	Event      cloudevents.Event `json:"event"`
+	ReceivedAt time.Time         `json:"receivedAt"`
+
+	size int64
+}
+
+// historyQuery selects entries from the history. Zero fields match all.
+type historyQuery struct {
+	ID     string
+	Type   string
+	Source string
+	Since  time.Time
+	Until  time.Time
+	// Limit caps the number of entries returned, newest first.
+	Limit int
+}
+
+func (q historyQuery) matches(e *historyEntry) bool {
+	if q.ID != "" && e.Event.ID() != q.ID {
+		return false
+	}
+	if q.Type != "" && e.Event.Type() != q.Type {
+		return false
+	}
+	if q.Source != "" && e.Event.Source() != q.Source {
+		return false
+	}
+	if !q.Since.IsZero() && e.ReceivedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.ReceivedAt.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// history is a bounded record of the most recent events, keyed by source and
+// ID.
+// It is limited both by count and by the approximate bytes of the events
+// held; the oldest entries are dropped first.
+type history struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	lru   *simplelru.LRU
+	bytes int64
+}
+
+// newHistory returns a history, or nil if size is not positive.
+func newHistory(size int, maxBytes int64) *history {
+	if size <= 0 {
+		return nil
+	}
+	h := &history{maxBytes: maxBytes}
+	// Only fails for a non-positive size.
+	h.lru, _ = simplelru.NewLRU(size, func(_, value interface{}) {
+		h.bytes -= value.(*historyEntry).size
+	})
+	return h
+}
+
+// Add records event. An event with the source and ID of one already held
+// replaces it.
+func (h *history) Add(event cloudevents.Event, now time.Time) {
+	if h == nil {
+		return
+	}
+	e := &historyEntry{Event: event, ReceivedAt: now, size: eventSize(&event)}
+	key := eventKey(&event)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if old, ok := h.lru.Peek(key); ok {
+		h.bytes -= old.(*historyEntry).size
+	}
+	h.lru.Add(key, e)
+	h.bytes += e.size
+	for h.maxBytes > 0 && h.bytes > h.maxBytes && h.lru.Len() > 1 {
+		h.lru.RemoveOldest()
+	}
+}
+
+// List returns the entries matching q, newest first.
+func (h *history) List(q historyQuery) []*historyEntry {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := h.lru.Keys()
+	entries := make([]*historyEntry, 0)
+	for i := len(keys) - 1; i >= 0; i-- {
+		v, _ := h.lru.Peek(keys[i])
+		e := v.(*historyEntry)
+		if !q.matches(e) {
+			continue
+		}
+		entries = append(entries, e)
+		if q.Limit > 0 && len(entries) >= q.Limit {
+			break
+		}
+	}
+	return entries
+}
+
+// Len returns the number of entries and the bytes they hold.
+func (h *history) Len() (int, int64) {
+	if h == nil {
+		return 0, 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lru.Len(), h.bytes
+}
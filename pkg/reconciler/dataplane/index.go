@@ -0,0 +1,133 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"sort"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+)
+
+// indexedTrigger is a loaded trigger with its compiled filter.
+type indexedTrigger struct {
+	trigger *eventingv1.Trigger
+	filter  filter
+}
+
+// triggerIndex is an immutable snapshot of the broker and its loaded
+// triggers. A trigger whose filter requires an exact type is kept under that
+// type, failing that one that requires an exact source under that source, and
+// any other trigger is a candidate for every event. Only the candidates of an
+// event have their filters evaluated.
+//
+// The snapshot is rebuilt whenever a trigger or the broker changes and then
+// swapped in whole, so the receiver matches without taking a lock.
+type triggerIndex struct {
+	broker   *eventingv1.Broker
+	byName   map[string]*indexedTrigger
+	byType   map[string][]*indexedTrigger
+	bySource map[string][]*indexedTrigger
+	rest     []*indexedTrigger
+}
+
+var emptyTriggerIndex = newTriggerIndex(nil, nil, nil)
+
+// newTriggerIndex indexes triggers and their filters, by trigger name.
+func newTriggerIndex(broker *eventingv1.Broker, triggers map[string]*eventingv1.Trigger, filters map[string]filter) *triggerIndex {
+	x := &triggerIndex{
+		broker:   broker,
+		byName:   make(map[string]*indexedTrigger, len(triggers)),
+		byType:   make(map[string][]*indexedTrigger),
+		bySource: make(map[string][]*indexedTrigger),
+	}
+	names := make([]string, 0, len(triggers))
+	for name := range triggers {
+		names = append(names, name)
+	}
+	// Candidates come out in name order.
+	sort.Strings(names)
+
+	for _, name := range names {
+		t := &indexedTrigger{trigger: triggers[name], filter: filters[name]}
+		x.byName[name] = t
+		keys := exactAttributes(t.filter, nil)
+		if v, ok := keys["type"]; ok {
+			x.byType[v] = append(x.byType[v], t)
+		} else if v, ok := keys["source"]; ok {
+			x.bySource[v] = append(x.bySource[v], t)
+		} else {
+			x.rest = append(x.rest, t)
+		}
+	}
+	return x
+}
+
+// exactAttributes collects the attributes f requires to equal a value, adding
+// them to keys. Only exact matches every event must pass are collected, those
+// under any or not are not.
+func exactAttributes(f filter, keys map[string]string) map[string]string {
+	switch f := f.(type) {
+	case exactFilter:
+		if keys == nil {
+			keys = make(map[string]string)
+		}
+		keys[f.attribute] = f.value
+	case allFilter:
+		for _, c := range f {
+			keys = exactAttributes(c, keys)
+		}
+	}
+	return keys
+}
+
+// match returns the triggers event goes to, and the names of the triggers
+// whose filters were evaluated to decide. Triggers in acked are skipped, and
+// when only is set, every other trigger is too.
+func (x *triggerIndex) match(event *cloudevents.Event, only string, acked map[string]bool) (evaluated []string, matched []*eventingv1.Trigger) {
+	e := newFilterEvent(event)
+	try := func(t *indexedTrigger) {
+		if acked[t.trigger.Name] {
+			// Finished with this event before a restart.
+			return
+		}
+		evaluated = append(evaluated, t.trigger.Name)
+		if t.filter == nil || t.filter.matches(e) {
+			matched = append(matched, t.trigger)
+		}
+	}
+
+	if only != "" {
+		if t, ok := x.byName[only]; ok {
+			try(t)
+		}
+		return evaluated, matched
+	}
+	for _, t := range x.byType[event.Type()] {
+		try(t)
+	}
+	for _, t := range x.bySource[event.Source()] {
+		try(t)
+	}
+	for _, t := range x.rest {
+		try(t)
+	}
+	return evaluated, matched
+}
+
+// triggerIndex returns the current snapshot of the loaded triggers.
+func (r *Reconciler) triggerIndex() *triggerIndex {
+	if x, ok := r.index.Load().(*triggerIndex); ok {
+		return x
+	}
+	return emptyTriggerIndex
+}
+
+// reindex publishes a new snapshot of the loaded triggers. r.mux must be
+// held, so snapshots are published in the order the changes were made.
+func (r *Reconciler) reindex() {
+	r.index.Store(newTriggerIndex(r.broker, r.triggers, r.filters))
+}
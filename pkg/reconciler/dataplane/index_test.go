@@ -0,0 +1,192 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+)
+
+func TestTriggerIndexMatch(t *testing.T) {
+	sf := func(f ...eventingv1.SubscriptionsAPIFilter) []eventingv1.SubscriptionsAPIFilter { return f }
+	specs := map[string]eventingv1.TriggerSpec{
+		"everything": {},
+		"by-type":    {Filter: &eventingv1.TriggerFilter{Attributes: eventingv1.TriggerFilterAttributes{"type": "test.type"}}},
+		"by-type-and-source": {Filter: &eventingv1.TriggerFilter{Attributes: eventingv1.TriggerFilterAttributes{
+			"type": "test.type", "source": "other",
+		}}},
+		"by-source": {Filters: sf(eventingv1.SubscriptionsAPIFilter{Exact: map[string]string{"source": "test"}})},
+		"other-type": {Filters: sf(eventingv1.SubscriptionsAPIFilter{All: sf(
+			eventingv1.SubscriptionsAPIFilter{Exact: map[string]string{"type": "other.type"}},
+		)})},
+		"any-type": {Filters: sf(eventingv1.SubscriptionsAPIFilter{Any: sf(
+			eventingv1.SubscriptionsAPIFilter{Exact: map[string]string{"type": "other.type"}},
+			eventingv1.SubscriptionsAPIFilter{Exact: map[string]string{"type": "test.type"}},
+		)})},
+		"not-type": {Filters: sf(eventingv1.SubscriptionsAPIFilter{Not: &eventingv1.SubscriptionsAPIFilter{
+			Exact: map[string]string{"type": "test.type"},
+		}})},
+		"prefix": {Filters: sf(eventingv1.SubscriptionsAPIFilter{Prefix: map[string]string{"type": "test."}})},
+	}
+	triggers, filters := compileTriggers(t, specs)
+	x := newTriggerIndex(nil, triggers, filters)
+
+	tests := []struct {
+		name      string
+		only      string
+		acked     map[string]bool
+		want      []string
+		evaluated []string
+	}{{
+		name:      "all triggers",
+		want:      []string{"any-type", "by-source", "by-type", "everything", "prefix"},
+		evaluated: []string{"any-type", "by-source", "by-type", "by-type-and-source", "everything", "not-type", "prefix"},
+	}, {
+		name:      "acked triggers are skipped",
+		acked:     map[string]bool{"by-type": true, "everything": true},
+		want:      []string{"any-type", "by-source", "prefix"},
+		evaluated: []string{"any-type", "by-source", "by-type-and-source", "not-type", "prefix"},
+	}, {
+		name:      "only one trigger",
+		only:      "by-source",
+		want:      []string{"by-source"},
+		evaluated: []string{"by-source"},
+	}, {
+		name: "only an unknown trigger",
+		only: "missing",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			event := testEvent()
+			evaluated, matched := x.match(&event, tc.only, tc.acked)
+			if got := triggerNames(matched); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("matched = %v, want %v", got, tc.want)
+			}
+			sort.Strings(evaluated)
+			if fmt.Sprint(evaluated) != fmt.Sprint(tc.evaluated) {
+				t.Errorf("evaluated = %v, want %v", evaluated, tc.evaluated)
+			}
+		})
+	}
+}
+
+func compileTriggers(tb testing.TB, specs map[string]eventingv1.TriggerSpec) (map[string]*eventingv1.Trigger, map[string]filter) {
+	triggers := make(map[string]*eventingv1.Trigger, len(specs))
+	filters := make(map[string]filter, len(specs))
+	for name, spec := range specs {
+		trigger := &eventingv1.Trigger{Spec: spec}
+		trigger.Name = name
+		f, err := compileFilter(trigger)
+		if err != nil {
+			tb.Fatalf("compileFilter(%s) = %v", name, err)
+		}
+		triggers[name] = trigger
+		filters[name] = f
+	}
+	return triggers, filters
+}
+
+func triggerNames(triggers []*eventingv1.Trigger) []string {
+	names := make([]string, 0, len(triggers))
+	for _, t := range triggers {
+		names = append(names, t.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// benchmarkTriggers has n triggers, each on its own event type, the way a
+// broker with many consumers of distinct events tends to look.
+func benchmarkTriggers(b *testing.B, n int) (map[string]*eventingv1.Trigger, map[string]filter) {
+	specs := make(map[string]eventingv1.TriggerSpec, n)
+	for i := 0; i < n; i++ {
+		specs[fmt.Sprintf("trigger-%d", i)] = eventingv1.TriggerSpec{
+			Filter: &eventingv1.TriggerFilter{Attributes: eventingv1.TriggerFilterAttributes{
+				"type":   fmt.Sprintf("test.type.%d", i),
+				"source": "test",
+			}},
+		}
+	}
+	return compileTriggers(b, specs)
+}
+
+func BenchmarkMatch(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		triggers, filters := benchmarkTriggers(b, n)
+		event := cloudevents.NewEvent()
+		event.SetID("1")
+		event.SetSource("test")
+		event.SetType(fmt.Sprintf("test.type.%d", n/2))
+
+		// linear is how the receiver matched before the index: every
+		// trigger, under the reconciler's mutex.
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			var mu sync.Mutex
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var matched []*eventingv1.Trigger
+				mu.Lock()
+				for name, trigger := range triggers {
+					if f := filters[name]; f == nil || f.matches(newFilterEvent(&event)) {
+						matched = append(matched, trigger)
+					}
+				}
+				mu.Unlock()
+				if len(matched) != 1 {
+					b.Fatalf("matched %d triggers, want 1", len(matched))
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("indexed/%d", n), func(b *testing.B) {
+			r := &Reconciler{}
+			r.index.Store(newTriggerIndex(nil, triggers, filters))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, matched := r.triggerIndex().match(&event, "", nil)
+				if len(matched) != 1 {
+					b.Fatalf("matched %d triggers, want 1", len(matched))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMatchParallel(b *testing.B) {
+	triggers, filters := benchmarkTriggers(b, 1000)
+	event := cloudevents.NewEvent()
+	event.SetID("1")
+	event.SetSource("test")
+	event.SetType("test.type.500")
+
+	b.Run("linear", func(b *testing.B) {
+		var mu sync.Mutex
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				mu.Lock()
+				for name := range triggers {
+					filters[name].matches(newFilterEvent(&event))
+				}
+				mu.Unlock()
+			}
+		})
+	})
+
+	b.Run("indexed", func(b *testing.B) {
+		r := &Reconciler{}
+		r.index.Store(newTriggerIndex(nil, triggers, filters))
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				r.triggerIndex().match(&event, "", nil)
+			}
+		})
+	})
+}
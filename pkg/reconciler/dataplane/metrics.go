@@ -0,0 +1,221 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"go.opencensus.io/resource"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	eventingmetrics "knative.dev/eventing/pkg/metrics"
+	"knative.dev/pkg/metrics"
+	"knative.dev/pkg/metrics/metricskey"
+	"knative.dev/pkg/system"
+)
+
+var (
+	// eventCountM counts events, both those received by the broker, recorded
+	// against the Broker resource, and those dispatched to a subscriber,
+	// recorded against the Trigger resource.
+	eventCountM = stats.Int64(
+		"event_count",
+		"Number of events received by a Broker or a Trigger",
+		stats.UnitDimensionless,
+	)
+
+	// dispatchTimeInMsecM records the time spent dispatching an event to a
+	// Trigger subscriber, retries and their backoff included, in
+	// milliseconds.
+	dispatchTimeInMsecM = stats.Float64(
+		"event_dispatch_latencies",
+		"The time spent dispatching an event to a Trigger subscriber",
+		stats.UnitMilliseconds,
+	)
+
+	// replyCountM counts the replies subscribers sent back into the broker.
+	replyCountM = stats.Int64(
+		"reply_count",
+		"Number of subscriber replies routed back into the broker",
+		stats.UnitDimensionless,
+	)
+
+	// breakerStateM is the state of a subscriber circuit breaker: 0 closed,
+	// 1 half-open, 2 open.
+	breakerStateM = stats.Int64(
+		"circuit_breaker_state",
+		"State of the subscriber circuit breaker, 0 closed, 1 half-open, 2 open",
+		stats.UnitDimensionless,
+	)
+
+	// dedupeHitCountM counts the duplicate events acknowledged at ingress
+	// but not fanned out.
+	dedupeHitCountM = stats.Int64(
+		"dedupe_hit_count",
+		"Number of duplicate events dropped at ingress",
+		stats.UnitDimensionless,
+	)
+
+	brokerKey     = tag.MustNewKey("broker_name")
+	triggerKey    = tag.MustNewKey("trigger_name")
+	resultKey     = tag.MustNewKey("result")
+	subscriberKey = tag.MustNewKey("subscriber_uri")
+
+	eventTypeKey         = tag.MustNewKey(eventingmetrics.LabelEventType)
+	filterTypeKey        = tag.MustNewKey(eventingmetrics.LabelFilterType)
+	responseCodeKey      = tag.MustNewKey(eventingmetrics.LabelResponseCode)
+	responseCodeClassKey = tag.MustNewKey(eventingmetrics.LabelResponseCodeClass)
+)
+
+// anyValue is the filter type of a trigger without a type filter.
+const anyValue = "any"
+
+const (
+	replyResultAccepted    = "accepted"
+	replyResultTTLExceeded = "ttl_exceeded"
+	replyResultFailed      = "failed"
+)
+
+func registerViews() error {
+	// The broker and trigger measures share names, they are told apart by the
+	// resource they are recorded against.
+	err := metrics.RegisterResourceView(
+		&view.View{
+			Description: eventCountM.Description(),
+			Measure:     eventCountM,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{eventTypeKey, filterTypeKey, responseCodeKey, responseCodeClassKey},
+		},
+		&view.View{
+			Description: dispatchTimeInMsecM.Description(),
+			Measure:     dispatchTimeInMsecM,
+			Aggregation: view.Distribution(metrics.Buckets125(1, 10000)...), // 1, 2, 5, 10, 20, 50, 100, 1000, 5000, 10000
+			TagKeys:     []tag.Key{eventTypeKey, filterTypeKey, responseCodeKey, responseCodeClassKey},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return view.Register(
+		&view.View{
+			Description: replyCountM.Description(),
+			Measure:     replyCountM,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{brokerKey, triggerKey, resultKey},
+		},
+		&view.View{
+			Description: breakerStateM.Description(),
+			Measure:     breakerStateM,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{brokerKey, subscriberKey},
+		},
+		&view.View{
+			Description: dedupeHitCountM.Description(),
+			Measure:     dedupeHitCountM,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{brokerKey},
+		},
+	)
+}
+
+func (r *Reconciler) recordReply(ctx context.Context, trigger, result string) {
+	ctx, err := tag.New(ctx,
+		tag.Insert(brokerKey, r.name),
+		tag.Insert(triggerKey, trigger),
+		tag.Insert(resultKey, result),
+	)
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, replyCountM.M(1))
+}
+
+func (r *Reconciler) recordBreakerState(uri string, state breakerState) {
+	ctx, err := tag.New(context.Background(),
+		tag.Insert(brokerKey, r.name),
+		tag.Insert(subscriberKey, uri),
+	)
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, breakerStateM.M(int64(state)))
+}
+
+func (r *Reconciler) recordDedupeHit() {
+	ctx, err := tag.New(context.Background(), tag.Insert(brokerKey, r.name))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, dedupeHitCountM.M(1))
+}
+
+// recordIngress counts an event sent to the broker by the status it was
+// answered with.
+func (r *Reconciler) recordIngress(eventType string, status int) {
+	ctx := metricskey.WithResource(context.Background(), resource.Resource{
+		Type: eventingmetrics.ResourceTypeKnativeBroker,
+		Labels: map[string]string{
+			eventingmetrics.LabelNamespaceName: system.Namespace(),
+			eventingmetrics.LabelBrokerName:    r.name,
+		},
+	})
+	ctx, err := tag.New(ctx,
+		tag.Insert(eventTypeKey, valueOrAny(eventType)),
+		tag.Insert(responseCodeKey, strconv.Itoa(status)),
+		tag.Insert(responseCodeClassKey, metrics.ResponseCodeClass(status)),
+	)
+	if err != nil {
+		return
+	}
+	metrics.Record(ctx, eventCountM.M(1))
+}
+
+// recordDispatch counts the delivery d by the status of its last attempt, and
+// records how long all of its attempts took. A delivery that was never
+// attempted counts with no status.
+func (r *Reconciler) recordDispatch(d *delivery, attempts []attempt) {
+	ctx := metricskey.WithResource(context.Background(), resource.Resource{
+		Type: eventingmetrics.ResourceTypeKnativeTrigger,
+		Labels: map[string]string{
+			eventingmetrics.LabelNamespaceName: d.trigger.Namespace,
+			eventingmetrics.LabelBrokerName:    r.name,
+			eventingmetrics.LabelTriggerName:   d.trigger.Name,
+		},
+	})
+	filterType := ""
+	if d.trigger.Spec.Filter != nil {
+		filterType = d.trigger.Spec.Filter.Attributes["type"]
+	}
+	var elapsed time.Duration
+	for _, a := range attempts {
+		elapsed += a.Backoff + a.Latency
+	}
+	status := 0
+	if len(attempts) > 0 {
+		status = attempts[len(attempts)-1].Status
+	}
+	ctx, err := tag.New(ctx,
+		tag.Insert(eventTypeKey, valueOrAny(d.event.Type())),
+		tag.Insert(filterTypeKey, valueOrAny(filterType)),
+		tag.Insert(responseCodeKey, strconv.Itoa(status)),
+		tag.Insert(responseCodeClassKey, metrics.ResponseCodeClass(status)),
+	)
+	if err != nil {
+		return
+	}
+	metrics.Record(ctx, eventCountM.M(1))
+	metrics.Record(ctx, dispatchTimeInMsecM.M(float64(elapsed/time.Millisecond)))
+}
+
+func valueOrAny(v string) string {
+	if v != "" {
+		return v
+	}
+	return anyValue
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+	"knative.dev/pkg/metrics"
+	"knative.dev/pkg/metrics/metricstest"
+	_ "knative.dev/pkg/metrics/testing"
+)
+
+// Views stay registered for the life of the process.
+var registerViewsOnce sync.Once
+
+func TestRecordDispatchOncePerDelivery(t *testing.T) {
+	registerViewsOnce.Do(func() {
+		if err := registerViews(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// Drop what earlier runs recorded.
+	metrics.ClearMetersForTest()
+
+	r := &Reconciler{name: "default"}
+	d := &delivery{event: testEvent(), trigger: &eventingv1.Trigger{}}
+	d.trigger.Name, d.trigger.Namespace = "a", testNamespace
+	// Three attempts, the last accepted, over 360ms.
+	r.recordDispatch(d, []attempt{
+		{Status: http.StatusInternalServerError, Latency: 10 * time.Millisecond},
+		{Status: http.StatusServiceUnavailable, Latency: 20 * time.Millisecond, Backoff: 100 * time.Millisecond},
+		{Status: http.StatusAccepted, Latency: 30 * time.Millisecond, Backoff: 200 * time.Millisecond},
+	})
+
+	tags := map[string]string{
+		"event_type":          "test.type",
+		"filter_type":         anyValue,
+		"response_code":       "202",
+		"response_code_class": "2xx",
+	}
+	metricstest.CheckCountData(t, eventCountM.Name(), tags, 1)
+	metricstest.CheckDistributionData(t, dispatchTimeInMsecM.Name(), tags, 1, 360, 360)
+}
@@ -0,0 +1,249 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"go.opencensus.io/trace"
+)
+
+// retryAfterSeconds is what a saturated broker asks producers to wait.
+const retryAfterSeconds = 1
+
+var errSaturated = errors.New("broker is saturated")
+
+// envelope is an event accepted by the broker. It is held against the
+// ingress budget until every delivery it fanned out to has finished.
+type envelope struct {
+	span  *trace.Span
+	event cloudevents.Event
+	size  int64
+
+	// seq is the write-ahead log sequence, zero when there is no log.
+	seq uint64
+	// acked are the triggers already finished with the event in an earlier
+	// run. The fan-out skips them.
+	acked map[string]bool
+	// only, when set, limits the fan-out to the named trigger.
+	only string
+
+	// refs is the number of outstanding deliveries, plus one while the
+	// event is still being fanned out.
+	refs int32
+	q    *ingressQueue
+	// interrupted is non-zero once shutdown cut one of its deliveries short.
+	interrupted int32
+}
+
+// hold takes n more references on the envelope.
+func (e *envelope) hold(n int) {
+	atomic.AddInt32(&e.refs, int32(n))
+}
+
+// done releases one reference. The last one gives the envelope's budget
+// back to the queue.
+func (e *envelope) done() {
+	if atomic.AddInt32(&e.refs, -1) == 0 {
+		e.q.release(e)
+	}
+}
+
+// interrupt marks the envelope as not fully delivered, whatever its other
+// deliveries do.
+func (e *envelope) interrupt() {
+	atomic.StoreInt32(&e.interrupted, 1)
+}
+
+func (e *envelope) wasInterrupted() bool {
+	return atomic.LoadInt32(&e.interrupted) != 0
+}
+
+// ingressQueue hands accepted events to the fan-out. It bounds the number of
+// events in flight, and the approximate bytes they hold, from the moment
+// ingress accepts them until the last of their deliveries is finished.
+//
+// ingressQueue also implements the cloudevents http RateLimiter, so that a
+// saturated broker answers 429 with Retry-After before reading the body.
+type ingressQueue struct {
+	ch        chan *envelope
+	maxEvents int
+	maxBytes  int64
+	// released, if set, is called once an envelope is fully delivered.
+	released func(*envelope)
+	// rejected, if set, is called for each request turned away by Allow.
+	rejected func(req *http.Request)
+
+	mu     sync.Mutex
+	events int
+	bytes  int64
+}
+
+var _ cehttp.RateLimiter = (*ingressQueue)(nil)
+
+func newIngressQueue(maxEvents int, maxBytes int64) *ingressQueue {
+	if maxEvents < 1 {
+		maxEvents = 1
+	}
+	return &ingressQueue{
+		// Never more than maxEvents are admitted, so sends on ch cannot block.
+		ch:        make(chan *envelope, maxEvents),
+		maxEvents: maxEvents,
+		maxBytes:  maxBytes,
+	}
+}
+
+// Admit reserves room for event and returns its envelope, or nil when the
+// broker is saturated. The envelope must be handed to Push.
+func (q *ingressQueue) Admit(ctx context.Context, event cloudevents.Event) *envelope {
+	size := eventSize(&event)
+
+	q.mu.Lock()
+	if !q.fits(size) {
+		q.mu.Unlock()
+		return nil
+	}
+	q.events++
+	q.bytes += size
+	q.mu.Unlock()
+
+	return &envelope{
+		span:  trace.FromContext(ctx),
+		event: event,
+		size:  size,
+		refs:  1,
+		q:     q,
+	}
+}
+
+// Push queues an admitted envelope for fan-out.
+func (q *ingressQueue) Push(e *envelope) {
+	q.ch <- e
+}
+
+// fits reports whether an event of size bytes can be admitted. q.mu must be
+// held.
+func (q *ingressQueue) fits(size int64) bool {
+	if q.events >= q.maxEvents {
+		return false
+	}
+	// A single event larger than the whole budget is still let through when
+	// nothing else is in flight, rather than being rejected forever.
+	return q.maxBytes <= 0 || q.events == 0 || q.bytes+size <= q.maxBytes
+}
+
+func (q *ingressQueue) release(e *envelope) {
+	q.mu.Lock()
+	q.events--
+	q.bytes -= e.size
+	q.mu.Unlock()
+
+	if q.released != nil {
+		q.released(e)
+	}
+}
+
+// Run calls fn with each admitted envelope until ctx is done.
+func (q *ingressQueue) Run(ctx context.Context, fn func(context.Context, *envelope)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-q.ch:
+			fn(ctx, e)
+		}
+	}
+}
+
+// Allow implements cehttp.RateLimiter. It turns away event POSTs while the
+// queue is full, using Content-Length as the size hint.
+func (q *ingressQueue) Allow(_ context.Context, req *http.Request) (bool, uint64, error) {
+	if req.Method != http.MethodPost {
+		return true, 0, nil
+	}
+	size := req.ContentLength
+	if size < 0 {
+		size = 0
+	}
+
+	q.mu.Lock()
+	fits := q.fits(size)
+	q.mu.Unlock()
+	if !fits {
+		if q.rejected != nil {
+			q.rejected(req)
+		}
+		return false, retryAfterSeconds, nil
+	}
+	return true, 0, nil
+}
+
+// retryAfterOnSaturation makes sure every 429 ingress answers carries
+// Retry-After. Allow sets it itself, but an event that Allow let in and Admit
+// then turns away, in a race or because a chunked body gave no size hint, is
+// answered by the receiver, which cannot set headers.
+func retryAfterOnSaturation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			// Streams need the writer as it is.
+			next.ServeHTTP(w, req)
+			return
+		}
+		next.ServeHTTP(retryAfterWriter{w}, req)
+	})
+}
+
+type retryAfterWriter struct {
+	http.ResponseWriter
+}
+
+func (w retryAfterWriter) WriteHeader(status int) {
+	if status == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// queueStats is the queue section of GET /stats.
+type queueStats struct {
+	Events    int   `json:"events"`
+	Bytes     int64 `json:"bytes"`
+	MaxEvents int   `json:"maxEvents"`
+	MaxBytes  int64 `json:"maxBytes"`
+}
+
+func (q *ingressQueue) stats() queueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return queueStats{Events: q.events, Bytes: q.bytes, MaxEvents: q.maxEvents, MaxBytes: q.maxBytes}
+}
+
+// Close implements cehttp.RateLimiter.
+func (q *ingressQueue) Close(context.Context) error {
+	return nil
+}
+
+// eventSize approximates the memory held by an event.
+func eventSize(event *cloudevents.Event) int64 {
+	size := len(event.Data()) + len(event.ID()) + len(event.Source()) + len(event.Type()) +
+		len(event.Subject()) + len(event.DataSchema()) + len(event.DataContentType())
+	for k, v := range event.Extensions() {
+		size += len(k)
+		if s, ok := v.(string); ok {
+			size += len(s)
+		} else {
+			size += 8
+		}
+	}
+	return int64(size)
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+)
+
+func TestSaturatedIngressSetsRetryAfter(t *testing.T) {
+	// The byte budget has room for the size hint of a chunked request, but
+	// not for the event it carries.
+	q := newIngressQueue(10, 16)
+	held := testEvent()
+	if q.Admit(context.Background(), held) == nil {
+		t.Fatal("Admit() = nil, want room for the first event")
+	}
+
+	// Middleware is only attached to the server the receiver starts.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := cloudevents.NewHTTP(
+		cloudevents.WithListener(l),
+		cloudevents.WithMiddleware(retryAfterOnSaturation),
+		cehttp.WithRateLimiter(q),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := cloudevents.NewClient(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.StartReceiver(ctx, func(ctx context.Context, event cloudevents.Event) error {
+		if q.Admit(ctx, event) == nil {
+			return cloudevents.NewHTTPResult(http.StatusTooManyRequests, "broker is saturated")
+		}
+		return nil
+	})
+	body := `{"specversion":"1.0","id":"2","type":"test.type","source":"test","data":"a body bigger than the budget"}`
+	req, err := http.NewRequest(http.MethodPost, "http://"+l.Addr().String(), io.NopCloser(strings.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", cloudevents.ApplicationCloudEventsJSON)
+	req.ContentLength = -1 // Sent chunked, so Allow has no size hint.
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+}
+
+func TestRetryAfterOnSaturationLeavesOtherResponses(t *testing.T) {
+	h := retryAfterOnSaturation(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/", nil))
+		if got := w.Header().Get("Retry-After"); got != "" {
+			t.Errorf("%s: Retry-After = %q, want none", method, got)
+		}
+	}
+}
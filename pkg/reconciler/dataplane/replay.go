@@ -0,0 +1,133 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	replayPath = "/replay"
+
+	// replayExtension marks a replayed copy of an event with the time it
+	// was replayed.
+	replayExtension = "glassreplay"
+)
+
+// replayRequest is the body of POST /replay. Events are picked from the
+// history by ID, or by the time they were received when no IDs are given.
+type replayRequest struct {
+	IDs   []string  `json:"ids,omitempty"`
+	Since time.Time `json:"since,omitempty"`
+	Until time.Time `json:"until,omitempty"`
+	// Trigger, when set, sends the events only to the named trigger instead
+	// of fanning them out to every trigger. Its filter still applies.
+	Trigger string `json:"trigger,omitempty"`
+}
+
+// replayResponse is the body of a POST /replay response.
+type replayResponse struct {
+	Replayed []string `json:"replayed"`
+	// Missing are requested IDs no longer in the history.
+	Missing []string `json:"missing,omitempty"`
+	// Failed are events the broker could not take, usually because it is
+	// saturated.
+	Failed []string `json:"failed,omitempty"`
+}
+
+// serveReplay serves POST /replay, which re-injects events from the history.
+func (r *Reconciler) serveReplay(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var rr replayRequest
+	if err := json.NewDecoder(req.Body).Decode(&rr); err != nil {
+		http.Error(w, "malformed replay request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(rr.IDs) == 0 && rr.Since.IsZero() && rr.Until.IsZero() {
+		http.Error(w, "replay needs ids or a since/until time range", http.StatusBadRequest)
+		return
+	}
+	if rr.Trigger != "" {
+		r.mux.Lock()
+		_, ok := r.triggers[rr.Trigger]
+		r.mux.Unlock()
+		if !ok {
+			http.Error(w, "trigger not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	resp := replayResponse{Replayed: make([]string, 0)}
+	var events []cloudevents.Event
+	if len(rr.IDs) > 0 {
+		for _, id := range rr.IDs {
+			entries := r.history.List(historyQuery{ID: id})
+			if len(entries) == 0 {
+				resp.Missing = append(resp.Missing, id)
+			}
+			// Every source that sent an event with id, oldest first.
+			for i := len(entries) - 1; i >= 0; i-- {
+				events = append(events, entries[i].Event)
+			}
+		}
+	} else {
+		entries := r.history.List(historyQuery{Since: rr.Since, Until: rr.Until})
+		// Oldest first, the order they were first received in.
+		for i := len(entries) - 1; i >= 0; i-- {
+			events = append(events, entries[i].Event)
+		}
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, event := range events {
+		event = event.Clone()
+		event.SetExtension(replayExtension, now)
+		if err := r.replayEvent(req.Context(), event, rr.Trigger); err != nil {
+			r.logger.Warnw("failed to replay event", zap.String("id", event.ID()), zap.Error(err))
+			resp.Failed = append(resp.Failed, event.ID())
+			continue
+		}
+		resp.Replayed = append(resp.Replayed, event.ID())
+	}
+	r.logger.Infow("replayed events", zap.Int("replayed", len(resp.Replayed)), zap.String("trigger", rr.Trigger))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// replayEvent re-injects event. Without a trigger it goes through the normal
+// fan-out. A replay to a single trigger is not written to the write-ahead
+// log, as a restart would fan it out to every trigger. Replayed copies are
+// not kept in the history, so the original stays there.
+func (r *Reconciler) replayEvent(ctx context.Context, event cloudevents.Event, trigger string) error {
+	ctx, span := startEventSpan(ctx, replaySpanName, &event)
+	defer span.End()
+	var env *envelope
+	if trigger == "" {
+		var err error
+		if env, err = r.admit(ctx, event); err != nil {
+			return err
+		}
+	} else {
+		if r.backlogged(&event, trigger) {
+			return errSaturated
+		}
+		if env = r.queue.Admit(ctx, event); env == nil {
+			return errSaturated
+		}
+		env.only = trigger
+	}
+	r.queue.Push(env)
+	r.tailEvent(event)
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"knative.dev/pkg/apis"
+)
+
+func TestReplayKeepsOriginalRecords(t *testing.T) {
+	t.Setenv("SYSTEM_NAMESPACE", testNamespace)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer subscriber.Close()
+
+	uri, err := apis.ParseURL(subscriber.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := handlerTestTrigger(t, "a", "test.type"), handlerTestTrigger(t, "b", "test.type")
+	a.Status.SubscriberURI, b.Status.SubscriberURI = uri, uri
+	r := newHandlerTestReconciler(t, a, b)
+	r.httpClient = subscriber.Client()
+	r.history = newHistory(10, 0)
+	r.traces = newTraces(10)
+	r.dispatcher = newDispatcher(2, 0, 2, r.deliver)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.queue.Run(ctx, r.receiver)
+	go r.dispatcher.Run(ctx)
+
+	// delivered reports whether every delivery of every run went out.
+	delivered := func(runs int) bool {
+		tr, ok := r.traces.Get("1")
+		if !ok || len(tr.Replays) != runs {
+			return false
+		}
+		all := []map[string]*deliveryTrace{tr.Deliveries}
+		for _, rt := range tr.Replays {
+			all = append(all, rt.Deliveries)
+		}
+		for _, deliveries := range all {
+			for _, d := range deliveries {
+				if d.Result != deliveryDelivered {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	if err := r.accept(ctx, testEvent()); err != nil {
+		t.Fatalf("accept() = %v", err)
+	}
+	waitFor(t, func() bool { return delivered(0) })
+
+	for i, body := range []string{`{"ids":["1"]}`, `{"ids":["1"],"trigger":"b"}`} {
+		w := httptest.NewRecorder()
+		r.serveReplay(w, httptest.NewRequest(http.MethodPost, replayPath, strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("replay %s: status = %d, %s", body, w.Code, w.Body)
+		}
+		runs := i + 1
+		waitFor(t, func() bool { return delivered(runs) })
+	}
+
+	entries := r.history.List(historyQuery{ID: "1"})
+	if len(entries) != 1 {
+		t.Fatalf("history holds %d events with the ID, want the original", len(entries))
+	}
+	if _, ok := entries[0].Event.Extensions()[replayExtension]; ok {
+		t.Error("history holds a replayed copy, want the original")
+	}
+
+	tr, _ := r.traces.Get("1")
+	if tr.ReceivedAt.IsZero() || len(tr.Deliveries) != 2 {
+		t.Errorf("original run = %+v, want both deliveries", tr)
+	}
+	if rt := tr.Replays[0]; rt.Trigger != "" || len(rt.Deliveries) != 2 || rt.ReplayedAt.IsZero() {
+		t.Errorf("fan-out replay = %+v, want both deliveries", rt)
+	}
+	if rt := tr.Replays[1]; rt.Trigger != "b" || len(rt.Deliveries) != 1 || rt.Deliveries["b"] == nil {
+		t.Errorf("replay to b = %+v, want only b", rt)
+	}
+}
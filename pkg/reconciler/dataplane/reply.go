@@ -0,0 +1,78 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"context"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap"
+	"knative.dev/eventing/pkg/broker"
+)
+
+// defaultTTL is the number of times an event may be replied back into the
+// broker before it is dropped.
+const defaultTTL int32 = 255
+
+// defaultEventTTL sets the broker TTL extension on events that arrive
+// without one.
+func defaultEventTTL(event *cloudevents.Event) {
+	if _, err := broker.GetTTL(event.Context); err != nil {
+		_ = broker.SetTTL(event.Context, defaultTTL)
+	}
+}
+
+// reply routes a subscriber reply back into the broker through the ingress
+// queue, as if it had come in through ingress. The reply inherits the TTL
+// of the event that caused it minus one, and is dropped once that runs out so
+// a trigger that matches its own replies cannot loop forever.
+func (r *Reconciler) reply(ctx context.Context, d *delivery, reply cloudevents.Event) {
+	ttl, err := broker.GetTTL(d.event.Context)
+	if err != nil {
+		ttl = defaultTTL
+	}
+	ttl--
+
+	logger := r.logger.With(
+		zap.String("trigger", d.trigger.Name),
+		zap.String("id", d.event.ID()),
+		zap.String("reply.id", reply.ID()),
+		zap.String("reply.type", reply.Type()),
+		zap.Int32("reply.ttl", ttl),
+	)
+
+	if ttl <= 0 {
+		logger.Warn("dropping reply, TTL exceeded")
+		r.replied(ctx, d, reply, replyResultTTLExceeded)
+		return
+	}
+	if err := broker.SetTTL(reply.Context, ttl); err != nil {
+		logger.Errorw("failed to set reply TTL", zap.Error(err))
+		r.replied(ctx, d, reply, replyResultFailed)
+		return
+	}
+
+	// Trace the reply on from the subscriber when it says where it came from,
+	// and from the delivery otherwise.
+	ctx, span := startEventSpan(ctx, replySpanName, &reply)
+	defer span.End()
+
+	// Never wait for room here, the deliveries holding the queue are the
+	// ones that would have to finish first.
+	if err := r.accept(ctx, reply); err != nil {
+		logger.Errorw("failed to send reply", zap.Error(err))
+		r.replied(ctx, d, reply, replyResultFailed)
+		return
+	}
+	logger.Debug("reply routed back into broker")
+	r.replied(ctx, d, reply, replyResultAccepted)
+}
+
+// replied records what became of the reply to d.
+func (r *Reconciler) replied(ctx context.Context, d *delivery, reply cloudevents.Event, result string) {
+	r.recordReply(ctx, d.trigger.Name, result)
+	r.traceReply(d, reply.ID(), result)
+}
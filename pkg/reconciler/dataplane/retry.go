@@ -0,0 +1,62 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// shouldRetry follows the Knative data plane contract: network errors, 5xx,
+// 404, 408, 409 and 429 are retried, every other response is final.
+func shouldRetry(status int) bool {
+	if status == 0 {
+		// No response at all, a network error or timeout.
+		return true
+	}
+	if status >= 500 {
+		return true
+	}
+	switch status {
+	case http.StatusNotFound,
+		http.StatusRequestTimeout,
+		http.StatusConflict,
+		http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// retryAfter reads the Retry-After header of a 429 or 503 response, in
+// either the delay-seconds or HTTP-date form. max caps the result; a nil max
+// leaves it uncapped and a zero max opts out of Retry-After altogether.
+func retryAfter(status int, header http.Header, max *time.Duration, now time.Time) time.Duration {
+	if status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+		return 0
+	}
+	if max != nil && *max <= 0 {
+		return 0
+	}
+	v := header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+	}
+	if d < 0 {
+		return 0
+	}
+	if max != nil && d > *max {
+		return *max
+	}
+	return d
+}
@@ -0,0 +1,274 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	eventingduckv1 "knative.dev/eventing/pkg/apis/duck/v1"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+)
+
+func TestShouldRetry(t *testing.T) {
+	tests := map[int]bool{
+		0:                              true,
+		http.StatusBadRequest:          false,
+		http.StatusUnauthorized:        false,
+		http.StatusForbidden:           false,
+		http.StatusNotFound:            true,
+		http.StatusRequestTimeout:      true,
+		http.StatusConflict:            true,
+		http.StatusGone:                false,
+		http.StatusTooManyRequests:     true,
+		http.StatusInternalServerError: true,
+		http.StatusBadGateway:          true,
+		http.StatusServiceUnavailable:  true,
+	}
+	for status, want := range tests {
+		if got := shouldRetry(status); got != want {
+			t.Errorf("shouldRetry(%d) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	zero := time.Duration(0)
+	limit := 2 * time.Second
+
+	tests := []struct {
+		name   string
+		status int
+		value  string
+		max    *time.Duration
+		want   time.Duration
+	}{{
+		name:   "seconds",
+		status: http.StatusTooManyRequests,
+		value:  "3",
+		want:   3 * time.Second,
+	}, {
+		name:   "http date",
+		status: http.StatusServiceUnavailable,
+		value:  now.Add(5 * time.Second).Format(http.TimeFormat),
+		want:   5 * time.Second,
+	}, {
+		name:   "capped",
+		status: http.StatusTooManyRequests,
+		value:  "30",
+		max:    &limit,
+		want:   limit,
+	}, {
+		name:   "opted out",
+		status: http.StatusTooManyRequests,
+		value:  "30",
+		max:    &zero,
+	}, {
+		name:   "ignored for other statuses",
+		status: http.StatusInternalServerError,
+		value:  "30",
+	}, {
+		name:   "date in the past",
+		status: http.StatusTooManyRequests,
+		value:  now.Add(-time.Minute).Format(http.TimeFormat),
+	}, {
+		name:   "garbage",
+		status: http.StatusTooManyRequests,
+		value:  "soon",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set("Retry-After", tc.value)
+			if got := retryAfter(tc.status, header, tc.max, now); got != tc.want {
+				t.Errorf("retryAfter() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSendRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		retry    int
+		wantErr  bool
+		attempts int
+	}{{
+		name:     "accepted",
+		statuses: []int{http.StatusAccepted},
+		retry:    3,
+		attempts: 1,
+	}, {
+		name:     "retried until accepted",
+		statuses: []int{http.StatusServiceUnavailable, http.StatusNotFound, http.StatusOK},
+		retry:    3,
+		attempts: 3,
+	}, {
+		name:     "bad request is final",
+		statuses: []int{http.StatusBadRequest},
+		retry:    3,
+		wantErr:  true,
+		attempts: 1,
+	}, {
+		name:     "retries run out",
+		statuses: []int{http.StatusInternalServerError},
+		retry:    2,
+		wantErr:  true,
+		attempts: 3,
+	}, {
+		name:     "no retries",
+		statuses: []int{http.StatusInternalServerError},
+		wantErr:  true,
+		attempts: 1,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int32
+			subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				n := int(atomic.AddInt32(&calls, 1)) - 1
+				if n >= len(tc.statuses) {
+					n = len(tc.statuses) - 1
+				}
+				w.WriteHeader(tc.statuses[n])
+			}))
+			defer subscriber.Close()
+
+			r := &Reconciler{httpClient: subscriber.Client()}
+			p := deliveryPolicy{retry: tc.retry, backoffDelay: time.Millisecond}
+
+			res, err := r.send(context.Background(), p, subscriber.URL, testEvent(), nil)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("send() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if len(res.attempts) != tc.attempts {
+				t.Errorf("send() made %d attempts, want %d", len(res.attempts), tc.attempts)
+			}
+			if got := int(atomic.LoadInt32(&calls)); got != tc.attempts {
+				t.Errorf("subscriber saw %d requests, want %d", got, tc.attempts)
+			}
+		})
+	}
+}
+
+func TestSendHonorsRetryAfter(t *testing.T) {
+	var calls int32
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer subscriber.Close()
+
+	max := 50 * time.Millisecond
+	r := &Reconciler{httpClient: subscriber.Client()}
+	p := deliveryPolicy{retry: 1, backoffDelay: time.Millisecond, retryAfterMax: &max}
+
+	res, err := r.send(context.Background(), p, subscriber.URL, testEvent(), nil)
+	if err != nil {
+		t.Fatalf("send() = %v", err)
+	}
+	if len(res.attempts) != 2 {
+		t.Fatalf("send() made %d attempts, want 2", len(res.attempts))
+	}
+	if got := res.attempts[1].Backoff; got != max {
+		t.Errorf("backoff = %v, want Retry-After capped to %v", got, max)
+	}
+}
+
+func TestSendTimeoutIsRetried(t *testing.T) {
+	var calls int32
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer subscriber.Close()
+
+	r := &Reconciler{httpClient: subscriber.Client()}
+	p := deliveryPolicy{retry: 1, backoffDelay: time.Millisecond, timeout: 50 * time.Millisecond}
+
+	res, err := r.send(context.Background(), p, subscriber.URL, testEvent(), nil)
+	if err != nil {
+		t.Fatalf("send() = %v", err)
+	}
+	if len(res.attempts) != 2 || !res.attempts[0].TimedOut {
+		t.Errorf("attempts = %+v, want a timed out attempt then a success", res.attempts)
+	}
+}
+
+func TestSendReply(t *testing.T) {
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Ce-Specversion", "1.0")
+		w.Header().Set("Ce-Id", "reply-1")
+		w.Header().Set("Ce-Type", "reply.type")
+		w.Header().Set("Ce-Source", "subscriber")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer subscriber.Close()
+
+	r := &Reconciler{httpClient: subscriber.Client()}
+	res, err := r.send(context.Background(), deliveryPolicy{}, subscriber.URL, testEvent(), nil)
+	if err != nil {
+		t.Fatalf("send() = %v", err)
+	}
+	if res.reply == nil || res.reply.ID() != "reply-1" {
+		t.Errorf("reply = %v, want reply-1", res.reply)
+	}
+}
+
+func testEvent() cloudevents.Event {
+	event := cloudevents.NewEvent()
+	event.SetID("1")
+	event.SetType("test.type")
+	event.SetSource("test")
+	return event
+}
+
+func TestNewDeliveryPolicyTimeout(t *testing.T) {
+	brokerTimeout := "PT5S"
+	triggerTimeout := "PT1S"
+	tests := []struct {
+		name    string
+		broker  *string
+		trigger *string
+		want    time.Duration
+	}{{
+		name: "default",
+		want: 30 * time.Second,
+	}, {
+		name:   "broker",
+		broker: &brokerTimeout,
+		want:   5 * time.Second,
+	}, {
+		name:    "trigger overrides broker",
+		broker:  &brokerTimeout,
+		trigger: &triggerTimeout,
+		want:    time.Second,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			broker := &eventingv1.Broker{}
+			broker.Spec.Delivery = &eventingduckv1.DeliverySpec{Timeout: tc.broker}
+			trigger := &eventingv1.Trigger{}
+			trigger.Spec.Delivery = &eventingduckv1.DeliverySpec{Timeout: tc.trigger}
+			if got := newDeliveryPolicy(broker, trigger, 30*time.Second).timeout; got != tc.want {
+				t.Errorf("timeout = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+)
+
+const (
+	streamPath = "/events/stream"
+
+	// tailBuffer is how many messages a slow client may fall behind before
+	// messages to it are dropped.
+	tailBuffer = 256
+	// tailKeepAlive is how often an idle SSE stream sends a comment.
+	tailKeepAlive = 15 * time.Second
+)
+
+const (
+	tailKindEvent    = "event"
+	tailKindDelivery = "delivery"
+)
+
+// Delivery results, as reported on the tail.
+const (
+	deliveryDelivered    = "delivered"
+	deliveryDeadLettered = "dead_lettered"
+	deliveryFailed       = "failed"
+	deliveryCircuitOpen  = "circuit_open"
+)
+
+// deliveryOutcome is the result of delivering an event to one trigger.
+type deliveryOutcome struct {
+	Trigger    string    `json:"trigger"`
+	EventID    string    `json:"eventId"`
+	Subscriber string    `json:"subscriber"`
+	Result     string    `json:"result"`
+	Attempts   []attempt `json:"attempts,omitempty"`
+}
+
+// tailMessage is one message sent to tail clients.
+type tailMessage struct {
+	Kind     string             `json:"kind"`
+	Event    *cloudevents.Event `json:"event,omitempty"`
+	Delivery *deliveryOutcome   `json:"delivery,omitempty"`
+
+	// event is what client filters are matched against.
+	event *cloudevents.Event
+}
+
+// tailClient is one connected client of the tail.
+type tailClient struct {
+	ch         chan tailMessage
+	filter     filter
+	deliveries bool
+	dropped    uint64
+}
+
+// tail fans ingressed events, and delivery outcomes, out to the connected
+// clients. A client that does not keep up loses messages rather than slowing
+// the broker down.
+type tail struct {
+	mu      sync.Mutex
+	clients map[*tailClient]struct{}
+	closed  bool
+}
+
+func newTail() *tail {
+	return &tail{clients: make(map[*tailClient]struct{})}
+}
+
+// subscribe adds a client, or returns nil if the tail is closed.
+func (t *tail) subscribe(f filter, deliveries bool) *tailClient {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	c := &tailClient{
+		ch:         make(chan tailMessage, tailBuffer),
+		filter:     f,
+		deliveries: deliveries,
+	}
+	t.clients[c] = struct{}{}
+	return c
+}
+
+func (t *tail) unsubscribe(c *tailClient) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.clients[c]; ok {
+		delete(t.clients, c)
+		close(c.ch)
+	}
+}
+
+// publish hands m to every interested client without blocking.
+func (t *tail) publish(m tailMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := newFilterEvent(m.event)
+	for c := range t.clients {
+		if m.Kind == tailKindDelivery && !c.deliveries {
+			continue
+		}
+		if !c.filter.matches(e) {
+			continue
+		}
+		select {
+		case c.ch <- m:
+		default:
+			atomic.AddUint64(&c.dropped, 1)
+		}
+	}
+}
+
+// active reports whether anyone is listening.
+func (t *tail) active() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.clients) > 0
+}
+
+// Close disconnects every client.
+func (t *tail) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for c := range t.clients {
+		delete(t.clients, c)
+		close(c.ch)
+	}
+}
+
+// tailEvent publishes an event the broker accepted.
+func (r *Reconciler) tailEvent(event cloudevents.Event) {
+	if !r.tail.active() {
+		return
+	}
+	r.tail.publish(tailMessage{Kind: tailKindEvent, Event: &event, event: &event})
+}
+
+// tailDelivery publishes the outcome of delivering d.
+func (r *Reconciler) tailDelivery(d *delivery, result string, res *dispatchResult) {
+	if !r.tail.active() {
+		return
+	}
+	o := &deliveryOutcome{
+		Trigger:    d.trigger.Name,
+		EventID:    d.event.ID(),
+		Subscriber: d.trigger.Status.SubscriberURI.String(),
+		Result:     result,
+	}
+	if res != nil {
+		o.Attempts = res.attempts
+	}
+	r.tail.publish(tailMessage{Kind: tailKindDelivery, Delivery: o, event: &d.event})
+}
+
+// stream serves GET /events/stream, a live tail of the events passing
+// through the broker. It speaks WebSocket when asked to upgrade and
+// Server-Sent Events otherwise. Query parameters are attribute filters with
+// the same semantics as a Trigger filter, except deliveries=true, which also
+// streams the delivery outcome for each trigger.
+func (r *Reconciler) stream(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := eventingv1.TriggerFilterAttributes{}
+	deliveries := false
+	for k, v := range req.URL.Query() {
+		if k == "deliveries" {
+			deliveries = v[0] == "true"
+			continue
+		}
+		filter[k] = v[0]
+	}
+
+	c := r.tail.subscribe(newAttributesFilter(filter), deliveries)
+	if c == nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer r.tail.unsubscribe(c)
+	defer func() {
+		if n := atomic.LoadUint64(&c.dropped); n > 0 {
+			r.logger.Infow("tail client fell behind", zap.Uint64("dropped", n))
+		}
+	}()
+
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		r.streamWebSocket(w, req, c)
+		return
+	}
+	r.streamSSE(w, req, c)
+}
+
+func (r *Reconciler) streamSSE(w http.ResponseWriter, req *http.Request, c *tailClient) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(tailKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case m, ok := <-c.ch:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(m)
+			if err != nil {
+				r.logger.Errorw("failed to encode tail message", zap.Error(err))
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", m.Kind, b); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func (r *Reconciler) streamWebSocket(w http.ResponseWriter, req *http.Request, c *tailClient) {
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		// The tail is one way; reading only notices the client leaving.
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			var discard []byte
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+		}()
+
+		for {
+			select {
+			case <-gone:
+				return
+			case m, ok := <-c.ch:
+				if !ok {
+					return
+				}
+				if err := websocket.JSON.Send(ws, m); err != nil {
+					return
+				}
+			}
+		}
+	}}.ServeHTTP(w, req)
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/types"
+	"github.com/hashicorp/golang-lru/simplelru"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+)
+
+const (
+	deliveriesPath = "/deliveries"
+
+	// deliveryPending is the result of a delivery that has not finished.
+	deliveryPending = "pending"
+)
+
+// eventTrace is the delivery record of one event: which triggers were
+// evaluated, which matched, and how each matching delivery went.
+type eventTrace struct {
+	EventID string `json:"eventId"`
+	// ReceivedAt is zero when the record only holds replays of the event.
+	ReceivedAt time.Time `json:"receivedAt"`
+	// Evaluated maps each trigger evaluated to whether its filter matched.
+	// Triggers ruled out by their exact type or source are not evaluated.
+	Evaluated map[string]bool `json:"evaluated"`
+	// Deliveries are keyed by trigger name.
+	Deliveries map[string]*deliveryTrace `json:"deliveries"`
+	// Replays are the runs of replayed copies of the event, oldest first.
+	Replays []*replayTrace `json:"replays,omitempty"`
+}
+
+// replayTrace is the record of one replay of an event, like the record of
+// the event itself.
+type replayTrace struct {
+	ReplayedAt time.Time `json:"replayedAt"`
+	// Trigger is set when the replay went to that trigger alone.
+	Trigger    string                    `json:"trigger,omitempty"`
+	Evaluated  map[string]bool           `json:"evaluated"`
+	Deliveries map[string]*deliveryTrace `json:"deliveries"`
+
+	// key is the replay extension of the copy.
+	key string
+}
+
+// deliveryTrace is the record of delivering an event to one trigger.
+type deliveryTrace struct {
+	Subscriber string    `json:"subscriber"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+	Attempts   []attempt `json:"attempts,omitempty"`
+	// DeadLetter is set when the event was sent to the dead letter sink.
+	DeadLetter *sinkTrace `json:"deadLetter,omitempty"`
+	// Reply is set when the subscriber replied.
+	Reply *replyTrace `json:"reply,omitempty"`
+}
+
+// sinkTrace is the record of sending to the dead letter sink.
+type sinkTrace struct {
+	Target   string    `json:"target"`
+	Accepted bool      `json:"accepted"`
+	Attempts []attempt `json:"attempts,omitempty"`
+}
+
+// replyTrace is the record of routing a subscriber reply back into the broker.
+type replyTrace struct {
+	ID     string `json:"id"`
+	Result string `json:"result"`
+}
+
+func (t *eventTrace) clone() *eventTrace {
+	c := *t
+	c.Evaluated = cloneEvaluated(t.Evaluated)
+	c.Deliveries = cloneDeliveries(t.Deliveries)
+	c.Replays = nil
+	for _, rt := range t.Replays {
+		rc := *rt
+		rc.Evaluated = cloneEvaluated(rt.Evaluated)
+		rc.Deliveries = cloneDeliveries(rt.Deliveries)
+		c.Replays = append(c.Replays, &rc)
+	}
+	return &c
+}
+
+// evaluatedBy reports whether any run of the event evaluated trigger.
+func (t *eventTrace) evaluatedBy(trigger string) bool {
+	if _, ok := t.Evaluated[trigger]; ok {
+		return true
+	}
+	for _, rt := range t.Replays {
+		if _, ok := rt.Evaluated[trigger]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// deliveries returns the deliveries of the run of the event marked replay,
+// or of the original run when replay is empty.
+func (t *eventTrace) deliveries(replay string) (map[string]*deliveryTrace, bool) {
+	if replay == "" {
+		return t.Deliveries, true
+	}
+	for _, rt := range t.Replays {
+		if rt.key == replay {
+			return rt.Deliveries, true
+		}
+	}
+	return nil, false
+}
+
+func cloneEvaluated(m map[string]bool) map[string]bool {
+	c := make(map[string]bool, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func cloneDeliveries(m map[string]*deliveryTrace) map[string]*deliveryTrace {
+	c := make(map[string]*deliveryTrace, len(m))
+	for k, v := range m {
+		d := *v
+		d.Attempts = append([]attempt(nil), v.Attempts...)
+		if v.DeadLetter != nil {
+			dl := *v.DeadLetter
+			dl.Attempts = append([]attempt(nil), v.DeadLetter.Attempts...)
+			d.DeadLetter = &dl
+		}
+		if v.Reply != nil {
+			rp := *v.Reply
+			d.Reply = &rp
+		}
+		c[k] = &d
+	}
+	return c
+}
+
+// replayOf returns the replay extension of event, empty when event is not a
+// replayed copy.
+func replayOf(event *cloudevents.Event) string {
+	v, ok := event.Extensions()[replayExtension]
+	if !ok {
+		return ""
+	}
+	s, _ := types.ToString(v)
+	return s
+}
+
+// traces keeps the delivery records of the most recent events, keyed by
+// event ID. An event seen again starts a new record, while a replayed copy
+// adds a run to the record of the original.
+type traces struct {
+	mu  sync.Mutex
+	lru *simplelru.LRU
+}
+
+// newTraces returns a trace store, or nil if size is not positive.
+func newTraces(size int) *traces {
+	if size <= 0 {
+		return nil
+	}
+	// Only fails for a non-positive size.
+	lru, _ := simplelru.NewLRU(size, nil)
+	return &traces{lru: lru}
+}
+
+// evaluated starts the record of event with the triggers evaluated and the
+// ones whose filter matched, or the record of a run when event is a replayed
+// copy. only is the trigger a replay was sent to. Every match starts out
+// pending.
+func (ts *traces) evaluated(event *cloudevents.Event, only string, now time.Time, evaluated []string, matched []*eventingv1.Trigger) {
+	if ts == nil {
+		return
+	}
+	runEvaluated := make(map[string]bool, len(evaluated))
+	runDeliveries := make(map[string]*deliveryTrace, len(matched))
+	for _, name := range evaluated {
+		runEvaluated[name] = false
+	}
+	for _, trigger := range matched {
+		runEvaluated[trigger.Name] = true
+		runDeliveries[trigger.Name] = &deliveryTrace{
+			Subscriber: trigger.Status.SubscriberURI.String(),
+			Result:     deliveryPending,
+		}
+	}
+
+	id := event.ID()
+	replay := replayOf(event)
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if replay == "" {
+		ts.lru.Add(id, &eventTrace{
+			EventID:    id,
+			ReceivedAt: now,
+			Evaluated:  runEvaluated,
+			Deliveries: runDeliveries,
+		})
+		return
+	}
+
+	var t *eventTrace
+	if v, ok := ts.lru.Peek(id); ok {
+		t = v.(*eventTrace)
+	} else {
+		// The record of the original is gone, keep the replay anyway.
+		t = &eventTrace{
+			EventID:    id,
+			Evaluated:  make(map[string]bool),
+			Deliveries: make(map[string]*deliveryTrace),
+		}
+	}
+	replayedAt, err := time.Parse(time.RFC3339Nano, replay)
+	if err != nil {
+		replayedAt = now
+	}
+	t.Replays = append(t.Replays, &replayTrace{
+		ReplayedAt: replayedAt,
+		Trigger:    only,
+		Evaluated:  runEvaluated,
+		Deliveries: runDeliveries,
+		key:        replay,
+	})
+	// Adding it again makes it the most recent record.
+	ts.lru.Add(id, t)
+}
+
+// update calls fn with the delivery record of trigger for event, if the
+// record is still held.
+func (ts *traces) update(event *cloudevents.Event, trigger string, fn func(*deliveryTrace)) {
+	if ts == nil {
+		return
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	v, ok := ts.lru.Peek(event.ID())
+	if !ok {
+		return
+	}
+	deliveries, ok := v.(*eventTrace).deliveries(replayOf(event))
+	if !ok {
+		return
+	}
+	d, ok := deliveries[trigger]
+	if !ok {
+		d = &deliveryTrace{}
+		deliveries[trigger] = d
+	}
+	fn(d)
+}
+
+// Get returns a copy of the record for event id.
+func (ts *traces) Get(id string) (*eventTrace, bool) {
+	if ts == nil {
+		return nil, false
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	v, ok := ts.lru.Peek(id)
+	if !ok {
+		return nil, false
+	}
+	return v.(*eventTrace).clone(), true
+}
+
+// List returns copies of the records that evaluated trigger, or all of them
+// if trigger is empty, newest first.
+func (ts *traces) List(trigger string, limit int) []*eventTrace {
+	if ts == nil {
+		return nil
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	keys := ts.lru.Keys()
+	list := make([]*eventTrace, 0)
+	for i := len(keys) - 1; i >= 0; i-- {
+		v, _ := ts.lru.Peek(keys[i])
+		t := v.(*eventTrace)
+		if trigger != "" && !t.evaluatedBy(trigger) {
+			continue
+		}
+		list = append(list, t.clone())
+		if limit > 0 && len(list) >= limit {
+			break
+		}
+	}
+	return list
+}
+
+// traceDelivery records how delivering d went.
+func (r *Reconciler) traceDelivery(d *delivery, result string, res *dispatchResult, err error) {
+	r.traces.update(&d.event, d.trigger.Name, func(t *deliveryTrace) {
+		t.Subscriber = d.trigger.Status.SubscriberURI.String()
+		t.Result = result
+		if err != nil {
+			t.Error = err.Error()
+		}
+		if res != nil {
+			t.Attempts = res.attempts
+		}
+	})
+}
+
+// traceDeadLetter records sending d to the dead letter sink.
+func (r *Reconciler) traceDeadLetter(d *delivery, sink string, res *dispatchResult, accepted bool) {
+	r.traces.update(&d.event, d.trigger.Name, func(t *deliveryTrace) {
+		t.DeadLetter = &sinkTrace{Target: sink, Accepted: accepted, Attempts: res.attempts}
+	})
+}
+
+// traceReply records the fate of the reply to d.
+func (r *Reconciler) traceReply(d *delivery, id, result string) {
+	r.traces.update(&d.event, d.trigger.Name, func(t *deliveryTrace) {
+		t.Reply = &replyTrace{ID: id, Result: result}
+	})
+}
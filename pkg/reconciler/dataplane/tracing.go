@@ -0,0 +1,108 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"context"
+	"net/http"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/extensions"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/trace"
+	"knative.dev/pkg/tracing/propagation/tracecontextb3"
+)
+
+// Span names.
+const (
+	ingressSpanName  = "glassbroker.ingress"
+	dispatchSpanName = "glassbroker.dispatch"
+	replySpanName    = "glassbroker.reply"
+	replaySpanName   = "glassbroker.replay"
+)
+
+// traceFormat reads TraceContext or B3 headers and writes TraceContext, like
+// the Knative tracing middleware.
+var traceFormat = tracecontextb3.TraceContextEgress
+
+// ingressParentKey holds the SpanContext of the HTTP request an event came
+// in on.
+type ingressParentKey struct{}
+
+// propagateSpan writes the span the tracing middleware started for a request
+// back into its headers. The cloudevents receiver does not see the request
+// context, only the message headers, so this is how the ingress span finds
+// its parent. It must run inside the tracing middleware.
+func propagateSpan(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if span := trace.FromContext(req.Context()); span != nil {
+			traceFormat.SpanContextToRequest(span.SpanContext(), req)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// inboundTraceContext is a cloudevents inbound context decorator that keeps
+// the trace context of the HTTP request for ingress.
+func inboundTraceContext(ctx context.Context, m binding.Message) context.Context {
+	hm, ok := m.(*cehttp.Message)
+	if !ok {
+		return ctx
+	}
+	if sc, ok := traceFormat.SpanContextFromRequest(&http.Request{Header: hm.Header}); ok {
+		return context.WithValue(ctx, ingressParentKey{}, sc)
+	}
+	return ctx
+}
+
+// eventSpanContext reads the CloudEvents distributed tracing extension.
+func eventSpanContext(event *cloudevents.Event) (trace.SpanContext, bool) {
+	dt, ok := extensions.GetDistributedTracingExtension(*event)
+	if !ok {
+		return trace.SpanContext{}, false
+	}
+	req := &http.Request{Header: http.Header{}}
+	req.Header.Set("traceparent", dt.TraceParent)
+	if dt.TraceState != "" {
+		req.Header.Set("tracestate", dt.TraceState)
+	}
+	return (&tracecontext.HTTPFormat{}).SpanContextFromRequest(req)
+}
+
+// setEventSpanContext writes sc into the distributed tracing extension of
+// event.
+func setEventSpanContext(event *cloudevents.Event, sc trace.SpanContext) {
+	req := &http.Request{Header: http.Header{}}
+	(&tracecontext.HTTPFormat{}).SpanContextToRequest(sc, req)
+	extensions.DistributedTracingExtension{
+		TraceParent: req.Header.Get("traceparent"),
+		TraceState:  req.Header.Get("tracestate"),
+	}.AddTracingAttributes(event)
+}
+
+// startEventSpan starts a span for event coming into the broker. Its parent
+// is the HTTP request it came in on when there was one, and otherwise the
+// trace context the event carries, if any. The event is updated to carry the
+// new span.
+func startEventSpan(ctx context.Context, name string, event *cloudevents.Event) (context.Context, *trace.Span) {
+	var span *trace.Span
+	if sc, ok := ctx.Value(ingressParentKey{}).(trace.SpanContext); ok {
+		ctx, span = trace.StartSpanWithRemoteParent(ctx, name, sc, trace.WithSpanKind(trace.SpanKindServer))
+	} else if sc, ok := eventSpanContext(event); ok {
+		ctx, span = trace.StartSpanWithRemoteParent(ctx, name, sc, trace.WithSpanKind(trace.SpanKindServer))
+	} else {
+		ctx, span = trace.StartSpan(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+	}
+	span.AddAttributes(
+		trace.StringAttribute("cloudevents.id", event.ID()),
+		trace.StringAttribute("cloudevents.source", event.Source()),
+		trace.StringAttribute("cloudevents.type", event.Type()),
+	)
+	setEventSpanContext(event, span.SpanContext())
+	return ctx, span
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opencensus.io/trace"
+)
+
+func TestSendPropagatesTraceContext(t *testing.T) {
+	var mu sync.Mutex
+	var headers, extensions []string
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers = append(headers, r.Header.Get("traceparent"))
+		extensions = append(extensions, r.Header.Get("Ce-Traceparent"))
+		n := len(headers)
+		mu.Unlock()
+		if n == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer subscriber.Close()
+
+	ctx, parent := trace.StartSpan(context.Background(), "parent", trace.WithSampler(trace.AlwaysSample()))
+	defer parent.End()
+
+	event := testEvent()
+	setEventSpanContext(&event, parent.SpanContext())
+
+	r := &Reconciler{httpClient: subscriber.Client()}
+	if _, err := r.send(ctx, deliveryPolicy{retry: 1}, subscriber.URL, event, nil); err != nil {
+		t.Fatalf("send() = %v", err)
+	}
+
+	if len(headers) != 2 {
+		t.Fatalf("subscriber saw %d requests, want 2", len(headers))
+	}
+	for i := range headers {
+		if headers[i] == "" || headers[i] != extensions[i] {
+			t.Errorf("attempt %d: traceparent header %q and extension %q should match", i, headers[i], extensions[i])
+		}
+		sc, ok := traceFormat.SpanContextFromRequest(&http.Request{Header: http.Header{"Traceparent": {headers[i]}}})
+		if !ok {
+			t.Fatalf("attempt %d: malformed traceparent %q", i, headers[i])
+		}
+		if sc.TraceID != parent.SpanContext().TraceID {
+			t.Errorf("attempt %d: trace %s, want %s", i, sc.TraceID, parent.SpanContext().TraceID)
+		}
+		if sc.SpanID == parent.SpanContext().SpanID {
+			t.Errorf("attempt %d: sent the parent span, want a span per attempt", i)
+		}
+	}
+	if headers[0] == headers[1] {
+		t.Errorf("both attempts sent span %q, want a span per attempt", headers[0])
+	}
+
+	dt, _ := eventSpanContext(&event)
+	if dt.SpanID != parent.SpanContext().SpanID {
+		t.Errorf("send() changed the caller's event tracing extension")
+	}
+}
+
+func TestStartEventSpan(t *testing.T) {
+	_, parent := trace.StartSpan(context.Background(), "producer", trace.WithSampler(trace.AlwaysSample()))
+	defer parent.End()
+
+	// From the HTTP request.
+	event := testEvent()
+	ctx := context.WithValue(context.Background(), ingressParentKey{}, parent.SpanContext())
+	_, span := startEventSpan(ctx, ingressSpanName, &event)
+	span.End()
+	if got := span.SpanContext().TraceID; got != parent.SpanContext().TraceID {
+		t.Errorf("ingress span trace = %s, want the request's %s", got, parent.SpanContext().TraceID)
+	}
+	if sc, _ := eventSpanContext(&event); sc.SpanID != span.SpanContext().SpanID {
+		t.Errorf("event extension carries span %s, want the ingress span %s", sc.SpanID, span.SpanContext().SpanID)
+	}
+
+	// From the event alone.
+	event = testEvent()
+	setEventSpanContext(&event, parent.SpanContext())
+	_, span = startEventSpan(context.Background(), ingressSpanName, &event)
+	span.End()
+	if got := span.SpanContext().TraceID; got != parent.SpanContext().TraceID {
+		t.Errorf("ingress span trace = %s, want the event's %s", got, parent.SpanContext().TraceID)
+	}
+}
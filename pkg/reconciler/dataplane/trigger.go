@@ -8,8 +8,10 @@ package dataplane
 import (
 	"context"
 	"knative.dev/pkg/system"
+	"net/http"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	"go.uber.org/zap"
@@ -17,6 +19,7 @@ import (
 	triggerreconciler "knative.dev/eventing/pkg/client/injection/reconciler/eventing/v1/trigger"
 	eventinglisters "knative.dev/eventing/pkg/client/listers/eventing/v1"
 	"knative.dev/pkg/apis"
+	"knative.dev/pkg/controller"
 	"knative.dev/pkg/logging"
 	pkgreconciler "knative.dev/pkg/reconciler"
 	"knative.dev/pkg/resolver"
@@ -24,29 +27,60 @@ import (
 
 type Reconciler struct {
 	// name of the broker
-	name         string
-	brokerClass  string
-	brokerLister eventinglisters.BrokerLister
-	uriResolver  *resolver.URIResolver
+	name          string
+	brokerClass   string
+	brokerLister  eventinglisters.BrokerLister
+	triggerLister eventinglisters.TriggerLister
+	uriResolver   *resolver.URIResolver
+	// triggersSynced reports whether the trigger informer has synced.
+	triggersSynced func() bool
 
 	mux      sync.Mutex
 	triggers map[string]*eventingv1.Trigger
-	broker   *eventingv1.Broker
+	// filters are the compiled filters of triggers, by trigger name.
+	filters map[string]filter
+	broker  *eventingv1.Broker
+	// index is the *triggerIndex of triggers and broker, rebuilt under mux
+	// on every change and read by the receiver without it.
+	index atomic.Value
 
 	// Handler fields
 
-	ceChan   cloudevents.Client
-	logger   *zap.SugaredLogger
-	ceClient cloudevents.Client
-	isReady  *atomic.Value
+	queue      *ingressQueue
+	wal        *wal
+	history    *history
+	tail       *tail
+	traces     *traces
+	dedupe     *dedupe
+	counts     *triggerCounts
+	logger     *zap.SugaredLogger
+	ceClient   cloudevents.Client
+	httpClient *http.Client
+	// deliveryTimeout bounds attempts whose DeliverySpec sets no timeout.
+	deliveryTimeout time.Duration
+	isReady         *atomic.Value
+	dispatcher      *dispatcher
+	breakers        *breakers
+	// enqueue asks for a trigger to be reconciled.
+	enqueue func(interface{})
 }
 
 // HACK HACK HACK
 // this is going to manage custom a custom condition set for these triggers.
 
+// TriggerConditionSubscriberCircuit reports the circuit breaker of the
+// trigger's subscriber. It is informational and does not affect Ready.
+const TriggerConditionSubscriberCircuit apis.ConditionType = "SubscriberCircuitClosed"
+
+// TriggerConditionFilterCompiled reports whether the trigger's filters
+// compiled. A trigger whose filters do not compile is not Ready.
+const TriggerConditionFilterCompiled apis.ConditionType = "FilterCompiled"
+
 var triggerCondSet = apis.NewLivingConditionSet(
 	//eventingv1.TriggerConditionBroker,
-	eventingv1.TriggerConditionSubscriberResolved)
+	eventingv1.TriggerConditionSubscriberResolved,
+	eventingv1.TriggerConditionDeadLetterSinkResolved,
+	TriggerConditionFilterCompiled)
 
 func triggerInitializeConditions(ts *eventingv1.TriggerStatus) {
 	ts.Conditions = nil
@@ -61,6 +95,34 @@ func triggerMarkSubscriberResolvedFailed(ts *eventingv1.TriggerStatus, reason, m
 	triggerCondSet.Manage(ts).MarkFalse(eventingv1.TriggerConditionSubscriberResolved, reason, messageFormat, messageA...)
 }
 
+func triggerMarkDeadLetterSinkResolvedSucceeded(ts *eventingv1.TriggerStatus) {
+	triggerCondSet.Manage(ts).MarkTrue(eventingv1.TriggerConditionDeadLetterSinkResolved)
+}
+
+func triggerMarkDeadLetterSinkNotConfigured(ts *eventingv1.TriggerStatus) {
+	triggerCondSet.Manage(ts).MarkTrueWithReason(eventingv1.TriggerConditionDeadLetterSinkResolved, "DeadLetterSinkNotConfigured", "No dead letter sink is configured.")
+}
+
+func triggerMarkDeadLetterSinkResolvedFailed(ts *eventingv1.TriggerStatus, reason, messageFormat string, messageA ...interface{}) {
+	triggerCondSet.Manage(ts).MarkFalse(eventingv1.TriggerConditionDeadLetterSinkResolved, reason, messageFormat, messageA...)
+}
+
+func triggerMarkFilterCompiled(ts *eventingv1.TriggerStatus) {
+	triggerCondSet.Manage(ts).MarkTrue(TriggerConditionFilterCompiled)
+}
+
+func triggerMarkFilterFailed(ts *eventingv1.TriggerStatus, reason, messageFormat string, messageA ...interface{}) {
+	triggerCondSet.Manage(ts).MarkFalse(TriggerConditionFilterCompiled, reason, messageFormat, messageA...)
+}
+
+func triggerMarkSubscriberCircuit(ts *eventingv1.TriggerStatus, state breakerState) {
+	if state == breakerClosed {
+		triggerCondSet.Manage(ts).MarkTrue(TriggerConditionSubscriberCircuit)
+		return
+	}
+	triggerCondSet.Manage(ts).MarkFalse(TriggerConditionSubscriberCircuit, "Circuit"+state.String(), "Deliveries to the subscriber are held back after repeated failures.")
+}
+
 // Check that our Reconciler implements Interface
 var _ triggerreconciler.Interface = (*Reconciler)(nil)
 
@@ -71,6 +133,17 @@ func (r *Reconciler) ReconcileKind(ctx context.Context, o *eventingv1.Trigger) p
 
 	logging.FromContext(ctx).Infof("Reconciling Trigger: %s", o.Name)
 
+	f, err := compileFilter(o)
+	if err != nil {
+		logging.FromContext(ctx).Errorw("Unable to compile the Trigger's filters", zap.Error(err))
+		triggerMarkFilterFailed(&o.Status, "FilterCompileFailed", "%v", err)
+		// Stop delivering with the filters it had before.
+		r.removeTrigger(ctx, o)
+		// Only a change to the Trigger can fix this.
+		return controller.NewPermanentError(err)
+	}
+	triggerMarkFilterCompiled(&o.Status)
+
 	if o.Spec.Subscriber.Ref != nil && o.Spec.Subscriber.Ref.Namespace == "" {
 		// To call URIFromDestinationV1(ctx context.Context, dest v1.Destination, parent interface{}), dest.Ref must have a Namespace
 		// If Subscriber.Ref.Namespace is nil, We will use the Namespace of Trigger as the Namespace of dest.Ref
@@ -86,11 +159,32 @@ func (r *Reconciler) ReconcileKind(ctx context.Context, o *eventingv1.Trigger) p
 	}
 	o.Status.SubscriberURI = subscriberURI
 	triggerMarkSubscriberResolvedSucceeded(&o.Status)
+	triggerMarkSubscriberCircuit(&o.Status, r.breakers.state(subscriberURI.String()))
+
+	if o.Spec.Delivery != nil && o.Spec.Delivery.DeadLetterSink != nil {
+		dls := *o.Spec.Delivery.DeadLetterSink
+		if dls.Ref != nil && dls.Ref.Namespace == "" {
+			dls.Ref = dls.Ref.DeepCopy()
+			dls.Ref.Namespace = o.GetNamespace()
+		}
+		dlsURI, err := r.uriResolver.URIFromDestinationV1(ctx, dls, o)
+		if err != nil {
+			logging.FromContext(ctx).Errorw("Unable to get the DeadLetterSink's URI", zap.Error(err))
+			triggerMarkDeadLetterSinkResolvedFailed(&o.Status, "Unable to get the DeadLetterSink's URI", "%v", err)
+			o.Status.DeadLetterSinkURI = nil
+			return err
+		}
+		o.Status.DeadLetterSinkURI = dlsURI
+		triggerMarkDeadLetterSinkResolvedSucceeded(&o.Status)
+	} else {
+		o.Status.DeadLetterSinkURI = nil
+		triggerMarkDeadLetterSinkNotConfigured(&o.Status)
+	}
 
 	if b, err := r.brokerLister.Brokers(o.Namespace).Get(o.Spec.Broker); err == nil && b != nil {
 		r.addBroker(ctx, b)
 	}
-	r.addTrigger(ctx, o)
+	r.addTrigger(ctx, o, f)
 
 	return nil
 }
@@ -105,14 +199,17 @@ func (r *Reconciler) removeTrigger(ctx context.Context, o *eventingv1.Trigger) {
 	r.mux.Lock()
 	logging.FromContext(ctx).Infof("Delete trigger %s", o.Name)
 	delete(r.triggers, o.Name)
+	delete(r.filters, o.Name)
+	r.reindex()
 	r.mux.Unlock()
+	r.dispatcher.RemoveTrigger(o.Name)
 
 	for _, t := range r.triggers {
 		logging.FromContext(ctx).Infof("%s --> %s", t.Name, t.Status.SubscriberURI)
 	}
 }
 
-func (r *Reconciler) addTrigger(ctx context.Context, o *eventingv1.Trigger) {
+func (r *Reconciler) addTrigger(ctx context.Context, o *eventingv1.Trigger, f filter) {
 	if !o.Status.IsReady() {
 		return
 	}
@@ -124,6 +221,8 @@ func (r *Reconciler) addTrigger(ctx context.Context, o *eventingv1.Trigger) {
 
 	r.mux.Lock()
 	r.triggers[o.Name] = o
+	r.filters[o.Name] = f
+	r.reindex()
 	r.mux.Unlock()
 
 	for _, t := range r.triggers {
@@ -138,5 +237,6 @@ func (r *Reconciler) addBroker(ctx context.Context, o *eventingv1.Broker) {
 
 	r.mux.Lock()
 	r.broker = o
+	r.reindex()
 	r.mux.Unlock()
 }
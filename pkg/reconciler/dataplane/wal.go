@@ -0,0 +1,553 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/labels"
+	"knative.dev/pkg/system"
+)
+
+const (
+	// walExt and walLockExt end the names of a log and of its lock file,
+	// which start with the name of the dataplane that owns them.
+	walExt     = ".log"
+	walLockExt = ".lock"
+
+	// walCompactThreshold is the number of finished entries the log may
+	// carry before it is rewritten.
+	walCompactThreshold = 1024
+
+	// walReplayWait bounds how long replay waits for triggers to load.
+	walReplayWait = 30 * time.Second
+	// walReplayBackoff is the polling interval while replay waits.
+	walReplayBackoff = 250 * time.Millisecond
+	// walAdoptInterval is how often the logs of dataplanes that are gone are
+	// looked for.
+	walAdoptInterval = 30 * time.Second
+)
+
+var (
+	errWALClosed = errors.New("write-ahead log is closed")
+	errWALInUse  = errors.New("write-ahead log is in use by another dataplane")
+)
+
+// walRecord is one line of the log. Exactly one of Event, Ack or Done is set.
+type walRecord struct {
+	Seq   uint64             `json:"seq"`
+	Event *cloudevents.Event `json:"event,omitempty"`
+	// Ack is the name of a trigger that is finished with the event.
+	Ack string `json:"ack,omitempty"`
+	// Done marks the event finished for every trigger.
+	Done bool `json:"done,omitempty"`
+}
+
+// walEntry is an accepted event that has not finished delivery.
+type walEntry struct {
+	seq   uint64
+	event cloudevents.Event
+	acked map[string]bool
+}
+
+// wal is a file-backed write-ahead log of accepted events. An event is
+// appended, and synced, before ingress acknowledges it. Each trigger that
+// finishes with the event appends an ack, and once every delivery is finished
+// the event is marked done. Done entries are dropped when the log is
+// compacted.
+//
+// Dataplanes sharing a volume, as the old and new pods of a rollout do, each
+// keep their own log and hold a lock on it while they run. A log whose lock
+// is free was left by a dataplane that is gone, and is adopted by one still
+// running.
+type wal struct {
+	dir  string
+	path string
+
+	mu   sync.Mutex
+	lock *os.File
+	f    *os.File
+	seq  uint64
+	live map[uint64]*walEntry
+	// dead is the number of done entries still in the file.
+	dead int
+}
+
+// openWAL opens, or creates, the log of owner in dir, and locks it. Entries
+// left unfinished by a previous run are kept and returned by pending.
+func openWAL(dir, owner string) (*wal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	lock, ok, err := lockWALFile(filepath.Join(dir, owner+walLockExt), true)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errWALInUse
+	}
+	w := &wal{
+		dir:  dir,
+		path: filepath.Join(dir, owner+walExt),
+		lock: lock,
+	}
+	w.live, w.seq, err = loadWAL(w.path)
+	if err == nil {
+		w.mu.Lock()
+		err = w.rewrite()
+		w.mu.Unlock()
+	}
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// loadWAL reads the log at path, returning its unfinished entries and its
+// last sequence. A torn record at the end, left by a crash mid-write, ends
+// the log.
+func loadWAL(path string) (map[uint64]*walEntry, uint64, error) {
+	live := make(map[uint64]*walEntry)
+	var seq uint64
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return live, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return live, seq, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return live, seq, nil
+		}
+		if rec.Seq > seq {
+			seq = rec.Seq
+		}
+		switch {
+		case rec.Event != nil:
+			live[rec.Seq] = &walEntry{seq: rec.Seq, event: *rec.Event, acked: make(map[string]bool)}
+		case rec.Ack != "":
+			if e, ok := live[rec.Seq]; ok {
+				e.acked[rec.Ack] = true
+			}
+		case rec.Done:
+			delete(live, rec.Seq)
+		}
+	}
+}
+
+// adopt takes over the logs left by dataplanes that are gone. Their
+// unfinished entries are copied into this log, acks included, and returned in
+// the order they were accepted, and the orphaned logs are removed.
+func (w *wal) adopt() ([]*walEntry, error) {
+	locks, err := filepath.Glob(filepath.Join(w.dir, "*"+walLockExt))
+	if err != nil {
+		return nil, err
+	}
+	var adopted []*walEntry
+	for _, path := range locks {
+		if path == strings.TrimSuffix(w.path, walExt)+walLockExt {
+			continue
+		}
+		entries, err := w.adoptLog(path)
+		if err != nil {
+			return adopted, err
+		}
+		adopted = append(adopted, entries...)
+	}
+	return adopted, nil
+}
+
+// adoptLog adopts the log locked by the lock file at path, if its owner is
+// gone.
+func (w *wal) adoptLog(path string) ([]*walEntry, error) {
+	lock, ok, err := lockWALFile(path, false)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && !ok) {
+		// Adopted by someone else, or the owner is still running.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	log := strings.TrimSuffix(path, walLockExt) + walExt
+	live, _, err := loadWAL(log)
+	if err != nil {
+		return nil, err
+	}
+	orphans := make([]*walEntry, 0, len(live))
+	for _, e := range live {
+		orphans = append(orphans, e)
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].seq < orphans[j].seq })
+
+	w.mu.Lock()
+	adopted, err := w.appendEntries(orphans)
+	w.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// The log goes first, a lock file without one is harmless.
+	if err := os.Remove(log); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return adopted, nil
+}
+
+// pending returns the unfinished entries in the order they were accepted.
+func (w *wal) pending() []*walEntry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	entries := make([]*walEntry, 0, len(w.live))
+	for _, e := range w.live {
+		acked := make(map[string]bool, len(e.acked))
+		for t := range e.acked {
+			acked[t] = true
+		}
+		entries = append(entries, &walEntry{seq: e.seq, event: e.event, acked: acked})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	return entries
+}
+
+// Append durably records a newly accepted event and returns its sequence.
+func (w *wal) Append(event cloudevents.Event) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	appended, err := w.appendEntries([]*walEntry{{event: event}})
+	if err != nil {
+		return 0, err
+	}
+	return appended[0].seq, nil
+}
+
+// appendEntries durably appends a new live entry for each of entries, acks
+// included, and returns them. When writing or syncing fails none of them are
+// kept: ingress reports the failure, so they must not be replayed either.
+// w.mu must be held.
+func (w *wal) appendEntries(entries []*walEntry) ([]*walEntry, error) {
+	if w.f == nil {
+		return nil, errWALClosed
+	}
+	fi, err := w.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	seq := w.seq
+	appended := make([]*walEntry, 0, len(entries))
+	for _, e := range entries {
+		var a *walEntry
+		if a, err = w.appendEntry(e.event, e.acked); err != nil {
+			break
+		}
+		appended = append(appended, a)
+	}
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if err != nil {
+		w.rollback(fi.Size(), seq)
+		return nil, err
+	}
+	return appended, nil
+}
+
+// appendEntry writes event, and an ack for each trigger in acked, as a new
+// live entry. w.mu must be held.
+func (w *wal) appendEntry(event cloudevents.Event, acked map[string]bool) (*walEntry, error) {
+	w.seq++
+	seq := w.seq
+	if err := w.write(walRecord{Seq: seq, Event: &event}); err != nil {
+		return nil, err
+	}
+	e := &walEntry{seq: seq, event: event, acked: make(map[string]bool, len(acked))}
+	w.live[seq] = e
+	for t := range acked {
+		if err := w.write(walRecord{Seq: seq, Ack: t}); err != nil {
+			return nil, err
+		}
+		e.acked[t] = true
+	}
+	return e, nil
+}
+
+// rollback drops the entries appended since the file had size and the log
+// ended at seq. w.mu must be held.
+func (w *wal) rollback(size int64, seq uint64) {
+	for s := seq + 1; s <= w.seq; s++ {
+		delete(w.live, s)
+	}
+	// When the file cannot be cut back, the sequences stay used so the
+	// records left in it are not mistaken for later ones.
+	if err := w.f.Truncate(size); err == nil {
+		w.seq = seq
+	}
+}
+
+// Ack records that trigger is finished with the event. It is not synced, a
+// lost ack only means a redelivery after a crash.
+func (w *wal) Ack(seq uint64, trigger string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	e, ok := w.live[seq]
+	if !ok {
+		return nil
+	}
+	e.acked[trigger] = true
+	return w.write(walRecord{Seq: seq, Ack: trigger})
+}
+
+// Done records that every delivery of the event is finished, and compacts
+// the log once enough finished entries pile up.
+func (w *wal) Done(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.live[seq]; !ok {
+		return nil
+	}
+	delete(w.live, seq)
+	if err := w.write(walRecord{Seq: seq, Done: true}); err != nil {
+		return err
+	}
+	w.dead++
+	if w.dead >= walCompactThreshold && w.dead > len(w.live) {
+		return w.rewrite()
+	}
+	return nil
+}
+
+// Close closes the log file and releases its lock.
+func (w *wal) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	if lerr := w.lock.Close(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// write appends one record. w.mu must be held.
+func (w *wal) write(rec walRecord) error {
+	if w.f == nil {
+		return errWALClosed
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = w.f.Write(append(b, '\n'))
+	return err
+}
+
+// rewrite replaces the log with just the live entries and their acks, and
+// reopens it for appending. w.mu must be held.
+func (w *wal) rewrite() error {
+	tmp := w.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bw)
+	for _, e := range w.live {
+		event := e.event
+		if err := enc.Encode(walRecord{Seq: e.seq, Event: &event}); err != nil {
+			f.Close()
+			return err
+		}
+		for t := range e.acked {
+			if err := enc.Encode(walRecord{Seq: e.seq, Ack: t}); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		return err
+	}
+
+	if w.f != nil {
+		_ = w.f.Close()
+	}
+	w.f, err = os.OpenFile(w.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	w.dead = 0
+	return nil
+}
+
+// walAck marks the trigger of d finished with its event in the log.
+func (r *Reconciler) walAck(d *delivery) {
+	if r.wal == nil || d.env.seq == 0 || d.interrupted {
+		return
+	}
+	if err := r.wal.Ack(d.env.seq, d.trigger.Name); err != nil {
+		r.logger.Errorw("failed to ack event in write-ahead log", zap.String("trigger", d.trigger.Name), zap.Error(err))
+	}
+}
+
+// interrupted reports whether shutdown cut d short. Its event is then neither
+// acked nor done in the log, so the next run delivers it again.
+func (r *Reconciler) interrupted(d *delivery) bool {
+	if d.ctx.Err() == nil {
+		return false
+	}
+	d.interrupted = true
+	d.env.interrupt()
+	r.logger.Infow("delivery interrupted by shutdown", zap.String("trigger", d.trigger.Name), zap.String("id", d.event.ID()))
+	return true
+}
+
+// walDone marks a fully delivered envelope done in the log. An envelope with
+// an interrupted delivery stays in the log.
+func (r *Reconciler) walDone(e *envelope) {
+	if e.seq == 0 || e.wasInterrupted() {
+		return
+	}
+	if err := r.wal.Done(e.seq); err != nil {
+		r.logger.Errorw("failed to finish event in write-ahead log", zap.Uint64("seq", e.seq), zap.Error(err))
+	}
+}
+
+// replay re-queues the events a previous run accepted but did not finish,
+// then keeps adopting the logs of dataplanes that are gone until ctx is done.
+func (r *Reconciler) replay(ctx context.Context) {
+	entries := r.wal.pending()
+	r.waitForTriggers(ctx)
+	r.replayEntries(ctx, entries)
+
+	ticker := time.NewTicker(walAdoptInterval)
+	defer ticker.Stop()
+	for {
+		r.adoptWALs(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// adoptWALs replays the events left in the logs of dataplanes that are gone.
+func (r *Reconciler) adoptWALs(ctx context.Context) {
+	entries, err := r.wal.adopt()
+	if err != nil {
+		r.logger.Errorw("failed to adopt write-ahead logs", zap.Error(err))
+	}
+	r.replayEntries(ctx, entries)
+}
+
+// replayEntries re-queues the events of entries. The triggers each event was
+// already delivered to are skipped.
+func (r *Reconciler) replayEntries(ctx context.Context, entries []*walEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	r.logger.Infow("replaying write-ahead log", zap.Int("events", len(entries)))
+
+	for _, e := range entries {
+		// The log keeps the trace context the event was accepted with.
+		event := e.event.Clone()
+		ectx, span := startEventSpan(ctx, replaySpanName, &event)
+		var env *envelope
+		for env == nil {
+			if env = r.queue.Admit(ectx, event); env == nil {
+				select {
+				case <-ctx.Done():
+					span.End()
+					return
+				case <-time.After(walReplayBackoff):
+				}
+			}
+		}
+		env.seq = e.seq
+		env.acked = e.acked
+		r.queue.Push(env)
+		span.End()
+	}
+}
+
+// waitForTriggers gives the trigger reconciler a chance to load every ready
+// trigger of this broker, so replayed events fan out the way they would have.
+func (r *Reconciler) waitForTriggers(ctx context.Context) {
+	timeout := time.After(walReplayWait)
+	for {
+		if r.triggersSynced() && r.triggersLoaded() {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-timeout:
+			r.logger.Warn("timed out waiting for triggers, replaying anyway")
+			return
+		case <-time.After(walReplayBackoff):
+		}
+	}
+}
+
+func (r *Reconciler) triggersLoaded() bool {
+	triggers, err := r.triggerLister.Triggers(system.Namespace()).List(labels.Everything())
+	if err != nil {
+		return false
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, t := range triggers {
+		if t.Spec.Broker != r.name || !t.Status.IsReady() {
+			continue
+		}
+		if _, ok := r.triggers[t.Name]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockWALFile opens the lock file at path, creating it if create is set, and
+// takes an exclusive lock on it without waiting. ok is false when another
+// process holds the lock. The lock is held until the returned file is closed.
+func lockWALFile(path string, create bool) (f *os.File, ok bool, err error) {
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+	for {
+		f, err = os.OpenFile(path, flag, 0o644)
+		if err != nil {
+			return nil, false, err
+		}
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, false, nil
+		} else if err != nil {
+			f.Close()
+			return nil, false, err
+		}
+		// The file may have been removed by whoever held the lock before us,
+		// so the lock is only good if path still names it.
+		held, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, false, err
+		}
+		named, err := os.Stat(path)
+		if err == nil && os.SameFile(held, named) {
+			return f, true, nil
+		}
+		f.Close()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, false, err
+		}
+		if !create {
+			return nil, false, os.ErrNotExist
+		}
+	}
+}
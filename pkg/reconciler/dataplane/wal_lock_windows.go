@@ -0,0 +1,23 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import "os"
+
+// lockWALFile opens the lock file at path, creating it if create is set.
+// Without advisory locks there is no telling whether the owner of a log is
+// gone, so only a dataplane's own lock file, the one it creates, is reported
+// as held.
+func lockWALFile(path string, create bool) (*os.File, bool, error) {
+	if !create {
+		return nil, false, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, false, err
+	}
+	return f, true, nil
+}
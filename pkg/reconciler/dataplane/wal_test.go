@@ -0,0 +1,466 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dataplane
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+	eventinglisters "knative.dev/eventing/pkg/client/listers/eventing/v1"
+	"knative.dev/pkg/apis"
+	duckv1 "knative.dev/pkg/apis/duck/v1"
+)
+
+const (
+	testNamespace = "knative-eventing"
+	testWALOwner  = "dataplane-0"
+)
+
+func TestWALLoadStopsAtTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openWAL(dir, testWALOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2"} {
+		event := testEvent()
+		event.SetID(id)
+		if _, err := w.Append(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	// A crash mid-write leaves half a record at the end.
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":3,"event":{"specversion":"1.0","id":"3"`)
+	f.Close()
+
+	w, err = openWAL(dir, testWALOwner)
+	if err != nil {
+		t.Fatalf("openWAL() = %v", err)
+	}
+	defer w.Close()
+	if got := pendingIDs(w); got != "1,2" {
+		t.Errorf("pending = %s, want 1,2", got)
+	}
+	// The torn record is gone, so new records are not appended to it.
+	event := testEvent()
+	event.SetID("4")
+	if seq, err := w.Append(event); err != nil || seq != 3 {
+		t.Errorf("Append() = %d, %v, want 3", seq, err)
+	}
+}
+
+func TestWALAppendFailureKeepsNothing(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openWAL(dir, testWALOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// Writes to a read-only handle fail.
+	f := w.f
+	if w.f, err = os.Open(w.path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Append(testEvent()); err == nil {
+		t.Fatal("Append() = nil, want an error")
+	}
+	w.f.Close()
+	w.f = f
+	if entries := w.pending(); len(entries) != 0 {
+		t.Errorf("pending = %+v, want none", entries)
+	}
+
+	event := testEvent()
+	event.SetID("2")
+	if _, err := w.Append(event); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	w, err = openWAL(dir, testWALOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if got := pendingIDs(w); got != "2" {
+		t.Errorf("pending after reopening = %s, want 2", got)
+	}
+}
+
+func TestWALAckAndDone(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openWAL(dir, testWALOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seqs []uint64
+	for _, id := range []string{"1", "2", "3"} {
+		event := testEvent()
+		event.SetID(id)
+		seq, err := w.Append(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, seq)
+	}
+	if err := w.Ack(seqs[0], "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Ack(seqs[1], "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Done(seqs[1]); err != nil {
+		t.Fatal(err)
+	}
+	// Finished entries are not acked or done twice.
+	if err := w.Ack(seqs[1], "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Done(seqs[1]); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	w, err = openWAL(dir, testWALOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	entries := w.pending()
+	if got := pendingIDs(w); got != "1,3" {
+		t.Fatalf("pending = %s, want 1,3", got)
+	}
+	if !entries[0].acked["a"] || len(entries[0].acked) != 1 {
+		t.Errorf("acked = %v, want a", entries[0].acked)
+	}
+	if len(entries[1].acked) != 0 {
+		t.Errorf("acked = %v, want none", entries[1].acked)
+	}
+}
+
+func TestWALCompacts(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openWAL(dir, testWALOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	live := testEvent()
+	live.SetID("live")
+	liveSeq, err := w.Append(live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Ack(liveSeq, "a"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < walCompactThreshold; i++ {
+		seq, err := w.Append(testEvent())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Done(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := os.ReadFile(w.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the live entry and its ack are left.
+	if lines := bytes.Count(b, []byte("\n")); lines != 2 {
+		t.Errorf("log has %d lines after compaction, want 2", lines)
+	}
+	if w.dead != 0 {
+		t.Errorf("dead = %d, want 0", w.dead)
+	}
+	entries := w.pending()
+	if len(entries) != 1 || entries[0].seq != liveSeq || !entries[0].acked["a"] {
+		t.Errorf("pending = %+v, want the live entry acked by a", entries)
+	}
+}
+
+func TestWALLockedByOwner(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openWAL(dir, testWALOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openWAL(dir, testWALOwner); err != errWALInUse {
+		t.Errorf("openWAL() while open = %v, want %v", err, errWALInUse)
+	}
+	w.Close()
+	w, err = openWAL(dir, testWALOwner)
+	if err != nil {
+		t.Fatalf("openWAL() after Close = %v", err)
+	}
+	w.Close()
+}
+
+func TestWALAdoptsOrphanedLogs(t *testing.T) {
+	dir := t.TempDir()
+	old, err := openWAL(dir, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seqs []uint64
+	for _, id := range []string{"1", "2", "3"} {
+		event := testEvent()
+		event.SetID(id)
+		seq, err := old.Append(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, seq)
+	}
+	if err := old.Ack(seqs[0], "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Done(seqs[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := openWAL(dir, testWALOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	// The owner is still running.
+	if entries, err := w.adopt(); err != nil || len(entries) != 0 {
+		t.Fatalf("adopt() with the owner running = %+v, %v, want none", entries, err)
+	}
+
+	old.Close()
+	entries, err := w.adopt()
+	if err != nil {
+		t.Fatalf("adopt() = %v", err)
+	}
+	if len(entries) != 2 || entries[0].event.ID() != "1" || entries[1].event.ID() != "3" {
+		t.Fatalf("adopted = %+v, want 1,3", entries)
+	}
+	if !entries[0].acked["a"] || len(entries[1].acked) != 0 {
+		t.Errorf("acked = %v, %v, want a and none", entries[0].acked, entries[1].acked)
+	}
+	for _, path := range []string{old.path, strings.TrimSuffix(old.path, walExt) + walLockExt} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s is left behind: %v", filepath.Base(path), err)
+		}
+	}
+	if got := pendingIDs(w); got != "1,3" {
+		t.Errorf("pending = %s, want 1,3", got)
+	}
+
+	// The adopted entries survive a restart of the adopter.
+	w.Close()
+	w, err = openWAL(dir, testWALOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if got := pendingIDs(w); got != "1,3" {
+		t.Errorf("pending after reopening = %s, want 1,3", got)
+	}
+	if entries := w.pending(); !entries[0].acked["a"] {
+		t.Errorf("acked = %v, want a", entries[0].acked)
+	}
+}
+
+func TestWALReplaySkipsAckedTriggers(t *testing.T) {
+	t.Setenv("SYSTEM_NAMESPACE", testNamespace)
+	dir := t.TempDir()
+	w, err := openWAL(dir, testWALOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := w.Append(testEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Ack(seq, "a"); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	delivered := make(chan string, 2)
+	r := newWALTestReconciler(t, dir, "http://subscriber.example.com", func(d *delivery) {
+		delivered <- d.trigger.Name
+		d.env.done()
+	}, "a", "b")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.queue.Run(ctx, r.receiver)
+	go r.dispatcher.Run(ctx)
+	go r.replay(ctx)
+
+	select {
+	case name := <-delivered:
+		if name != "b" {
+			t.Errorf("replayed to %s, want b", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not replayed")
+	}
+	select {
+	case name := <-delivered:
+		t.Errorf("replayed to %s as well, want only b", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWALKeepsInterruptedDeliveries(t *testing.T) {
+	tests := []struct {
+		name string
+		// hang keeps the subscriber from answering until shutdown.
+		hang        bool
+		wantPending bool
+	}{{
+		name:        "shutdown mid-delivery",
+		hang:        true,
+		wantPending: true,
+	}, {
+		name: "subscriber failed",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("SYSTEM_NAMESPACE", testNamespace)
+			var calls int32
+			subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				if tc.hang {
+					<-req.Context().Done()
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+			}))
+			defer subscriber.Close()
+
+			dir := t.TempDir()
+			r := newWALTestReconciler(t, dir, subscriber.URL, nil, "a")
+			r.httpClient = subscriber.Client()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go r.queue.Run(ctx, r.receiver)
+			go r.dispatcher.Run(ctx)
+
+			if err := r.accept(ctx, testEvent()); err != nil {
+				t.Fatalf("accept() = %v", err)
+			}
+			waitFor(t, func() bool { return atomic.LoadInt32(&calls) > 0 })
+			if tc.hang {
+				cancel()
+			}
+			// The envelope is released once its delivery gave up.
+			waitFor(t, func() bool { return r.queue.stats().Events == 0 })
+			r.wal.Close()
+
+			w, err := openWAL(dir, testWALOwner)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			entries := w.pending()
+			if got := len(entries) == 1; got != tc.wantPending {
+				t.Fatalf("pending = %+v, want pending %v", entries, tc.wantPending)
+			}
+			if tc.wantPending && len(entries[0].acked) != 0 {
+				t.Errorf("acked = %v, want none", entries[0].acked)
+			}
+		})
+	}
+}
+
+// newWALTestReconciler has a write-ahead log in dir and ready triggers, all
+// pointing at subscriber. deliver defaults to the real one.
+func newWALTestReconciler(t *testing.T, dir, subscriber string, deliver func(*delivery), triggers ...string) *Reconciler {
+	t.Helper()
+	w, err := openWAL(dir, testWALOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	r := &Reconciler{
+		name:           "default",
+		triggerLister:  eventinglisters.NewTriggerLister(indexer),
+		triggersSynced: func() bool { return true },
+		logger:         zap.NewNop().Sugar(),
+		triggers:       make(map[string]*eventingv1.Trigger),
+		filters:        make(map[string]filter),
+		queue:          newIngressQueue(10, 0),
+		wal:            w,
+		tail:           newTail(),
+		counts:         newTriggerCounts(),
+		httpClient:     http.DefaultClient,
+	}
+	r.queue.released = r.walDone
+	if deliver == nil {
+		deliver = r.deliver
+	}
+	r.dispatcher = newDispatcher(2, 0, 2, deliver)
+
+	uri, err := apis.ParseURL(subscriber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range triggers {
+		trigger := &eventingv1.Trigger{}
+		trigger.Name = name
+		trigger.Namespace = testNamespace
+		trigger.Spec.Broker = r.name
+		trigger.Status.Conditions = duckv1.Conditions{{Type: apis.ConditionReady, Status: corev1.ConditionTrue}}
+		trigger.Status.SubscriberURI = uri
+		if err := indexer.Add(trigger); err != nil {
+			t.Fatal(err)
+		}
+		r.triggers[name] = trigger
+		r.filters[name] = allFilter{}
+	}
+	r.reindex()
+	return r
+}
+
+func pendingIDs(w *wal) string {
+	var ids []byte
+	for i, e := range w.pending() {
+		if i > 0 {
+			ids = append(ids, ',')
+		}
+		ids = append(ids, e.event.ID()...)
+	}
+	return string(ids)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,350 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package topology renders GlassBrokers, their triggers and the subscribers
+// and dead letter sinks those deliver to as a graph, in JSON or Graphviz DOT.
+package topology
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	eventingduckv1 "knative.dev/eventing/pkg/apis/duck/v1"
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+)
+
+// Kind is the kind of a node.
+type Kind string
+
+const (
+	KindBroker         Kind = "Broker"
+	KindTrigger        Kind = "Trigger"
+	KindSubscriber     Kind = "Subscriber"
+	KindDeadLetterSink Kind = "DeadLetterSink"
+)
+
+// Relation is what an edge stands for.
+type Relation string
+
+const (
+	// RelationRoutes is a broker routing events to a trigger.
+	RelationRoutes Relation = "routes"
+	// RelationDelivers is a trigger delivering to its subscriber.
+	RelationDelivers Relation = "delivers"
+	// RelationDeadLetters is a broker or trigger sending undeliverable
+	// events to a dead letter sink.
+	RelationDeadLetters Relation = "deadLetters"
+)
+
+// SettingsPrefix is the prefix of the GlassBroker annotations.
+const SettingsPrefix = "glass-broker.tableflip.dev/"
+
+// Node is a broker, trigger or endpoint. Endpoints are keyed by URI, so two
+// triggers delivering to the same subscriber share its node.
+type Node struct {
+	ID        string `json:"id"`
+	Kind      Kind   `json:"kind"`
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	URI       string `json:"uri,omitempty"`
+	// Filter is the trigger attribute filter.
+	Filter map[string]string `json:"filter,omitempty"`
+	// Filters are the trigger filters, which override Filter, rendered by
+	// FilterExpression.
+	Filters string `json:"filters,omitempty"`
+	// Delivery is the DeliverySpec, less its dead letter sink, which is an
+	// edge.
+	Delivery map[string]string `json:"delivery,omitempty"`
+	// Settings are the GlassBroker annotations, without their prefix.
+	Settings map[string]string `json:"settings,omitempty"`
+	// Ready is the Ready condition of a broker or trigger. Endpoints are
+	// always ready.
+	Ready bool `json:"ready"`
+}
+
+// Edge connects two nodes by ID.
+type Edge struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Relation Relation `json:"relation"`
+}
+
+// Graph is a topology. Build one with New and Add.
+type Graph struct {
+	Nodes []*Node `json:"nodes"`
+	Edges []Edge  `json:"edges"`
+
+	index map[string]*Node
+}
+
+// New returns an empty graph.
+func New() *Graph {
+	return &Graph{
+		Nodes: make([]*Node, 0),
+		Edges: make([]Edge, 0),
+		index: make(map[string]*Node),
+	}
+}
+
+// Add adds broker and the triggers bound to it. Triggers are added in name
+// order so the output is stable.
+func (g *Graph) Add(broker *eventingv1.Broker, triggers []*eventingv1.Trigger) {
+	bid := "broker/" + broker.Namespace + "/" + broker.Name
+	b := g.node(bid, KindBroker)
+	b.Name = broker.Name
+	b.Namespace = broker.Namespace
+	b.Delivery = DeliveryFields(broker.Spec.Delivery)
+	b.Settings = Settings(broker.Annotations)
+	b.Ready = broker.IsReady()
+	if dls := broker.Status.DeadLetterSinkURI; dls != nil {
+		g.endpoint(dls.String(), KindDeadLetterSink)
+		g.edge(bid, endpointID(dls.String()), RelationDeadLetters)
+	}
+
+	sorted := append([]*eventingv1.Trigger(nil), triggers...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	for _, trigger := range sorted {
+		tid := "trigger/" + trigger.Namespace + "/" + trigger.Name
+		t := g.node(tid, KindTrigger)
+		t.Name = trigger.Name
+		t.Namespace = trigger.Namespace
+		if len(trigger.Spec.Filters) > 0 {
+			t.Filters = FilterExpression(trigger.Spec.Filters)
+		} else if trigger.Spec.Filter != nil && len(trigger.Spec.Filter.Attributes) > 0 {
+			t.Filter = trigger.Spec.Filter.Attributes
+		}
+		t.Delivery = DeliveryFields(trigger.Spec.Delivery)
+		t.Settings = Settings(trigger.Annotations)
+		t.Ready = trigger.Status.IsReady()
+		g.edge(bid, tid, RelationRoutes)
+
+		if sub := trigger.Status.SubscriberURI; sub != nil {
+			g.endpoint(sub.String(), KindSubscriber)
+			g.edge(tid, endpointID(sub.String()), RelationDelivers)
+		}
+		if dls := trigger.Status.DeadLetterSinkURI; dls != nil {
+			g.endpoint(dls.String(), KindDeadLetterSink)
+			g.edge(tid, endpointID(dls.String()), RelationDeadLetters)
+		}
+	}
+}
+
+func (g *Graph) node(id string, kind Kind) *Node {
+	if n, ok := g.index[id]; ok {
+		return n
+	}
+	n := &Node{ID: id, Kind: kind, Ready: true}
+	g.index[id] = n
+	g.Nodes = append(g.Nodes, n)
+	return n
+}
+
+func endpointID(uri string) string {
+	return "uri/" + uri
+}
+
+func (g *Graph) endpoint(uri string, kind Kind) {
+	n := g.node(endpointID(uri), kind)
+	n.URI = uri
+}
+
+func (g *Graph) edge(from, to string, rel Relation) {
+	g.Edges = append(g.Edges, Edge{From: from, To: to, Relation: rel})
+}
+
+// DeliveryFields flattens the set fields of a DeliverySpec, leaving out the
+// dead letter sink.
+func DeliveryFields(spec *eventingduckv1.DeliverySpec) map[string]string {
+	if spec == nil {
+		return nil
+	}
+	f := make(map[string]string)
+	if spec.Retry != nil {
+		f["retry"] = strconv.Itoa(int(*spec.Retry))
+	}
+	if spec.BackoffPolicy != nil {
+		f["backoffPolicy"] = string(*spec.BackoffPolicy)
+	}
+	if spec.BackoffDelay != nil {
+		f["backoffDelay"] = *spec.BackoffDelay
+	}
+	if spec.Timeout != nil {
+		f["timeout"] = *spec.Timeout
+	}
+	if spec.RetryAfterMax != nil {
+		f["retryAfterMax"] = *spec.RetryAfterMax
+	}
+	if len(f) == 0 {
+		return nil
+	}
+	return f
+}
+
+// FilterExpression renders trigger filters as a CloudEvents SQL expression
+// that matches the same events.
+func FilterExpression(filters []eventingv1.SubscriptionsAPIFilter) string {
+	return joinFilters(filters, " AND ")
+}
+
+func joinFilters(filters []eventingv1.SubscriptionsAPIFilter, op string) string {
+	parts := make([]string, 0, len(filters))
+	for _, f := range filters {
+		parts = append(parts, filterExpression(f))
+	}
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	return "(" + strings.Join(parts, op) + ")"
+}
+
+func filterExpression(f eventingv1.SubscriptionsAPIFilter) string {
+	var parts []string
+	if len(f.All) > 0 {
+		parts = append(parts, joinFilters(f.All, " AND "))
+	}
+	if len(f.Any) > 0 {
+		parts = append(parts, joinFilters(f.Any, " OR "))
+	}
+	if f.Not != nil {
+		parts = append(parts, "NOT "+filterExpression(*f.Not))
+	}
+	parts = append(parts, attributeExpressions(f.Exact, "=", "", "")...)
+	parts = append(parts, attributeExpressions(f.Prefix, "LIKE", "", "%")...)
+	parts = append(parts, attributeExpressions(f.Suffix, "LIKE", "%", "")...)
+	if f.CESQL != "" {
+		parts = append(parts, "("+f.CESQL+")")
+	}
+	switch len(parts) {
+	case 0:
+		// An empty filter matches everything.
+		return "TRUE"
+	case 1:
+		return parts[0]
+	}
+	return "(" + strings.Join(parts, " AND ") + ")"
+}
+
+// attributeExpressions compares each attribute in m to its value, in
+// attribute order. LIKE patterns get before and after around the value.
+func attributeExpressions(m map[string]string, op, before, after string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	exprs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := m[k]
+		if op == "LIKE" {
+			v = likeEscaper.Replace(v)
+		}
+		exprs = append(exprs, k+" "+op+" '"+before+strings.ReplaceAll(v, "'", "''")+after+"'")
+	}
+	return exprs
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Settings returns the GlassBroker annotations without their prefix.
+func Settings(annotations map[string]string) map[string]string {
+	var s map[string]string
+	for k, v := range annotations {
+		if strings.HasPrefix(k, SettingsPrefix) {
+			if s == nil {
+				s = make(map[string]string)
+			}
+			s[strings.TrimPrefix(k, SettingsPrefix)] = v
+		}
+	}
+	return s
+}
+
+// WriteDOT renders g in the Graphviz DOT language.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph topology {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [fontname=\"Helvetica\", fontsize=10];\n")
+	b.WriteString("  edge [fontname=\"Helvetica\", fontsize=9];\n")
+	for _, n := range g.Nodes {
+		fmt.Fprintf(&b, "  %s [shape=%s, label=%s];\n", quote(n.ID), shape(n.Kind), quote(label(n)))
+	}
+	for _, e := range g.Edges {
+		style := "solid"
+		if e.Relation == RelationDeadLetters {
+			style = "dashed"
+		}
+		fmt.Fprintf(&b, "  %s -> %s [label=%s, style=%s];\n", quote(e.From), quote(e.To), quote(string(e.Relation)), style)
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func shape(k Kind) string {
+	switch k {
+	case KindBroker:
+		return "box3d"
+	case KindTrigger:
+		return "box"
+	case KindDeadLetterSink:
+		return "octagon"
+	}
+	return "ellipse"
+}
+
+// label is the kind, the name or URI, then the filters and one line per
+// filter, delivery and setting field.
+func label(n *Node) string {
+	lines := []string{string(n.Kind)}
+	if n.Name != "" {
+		lines = append(lines, n.Namespace+"/"+n.Name)
+	}
+	if n.URI != "" {
+		lines = append(lines, n.URI)
+	}
+	if !n.Ready {
+		lines = append(lines, "NOT READY")
+	}
+	if n.Filters != "" {
+		lines = append(lines, n.Filters)
+	}
+	for _, m := range []map[string]string{n.Filter, n.Delivery, n.Settings} {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			lines = append(lines, k+"="+m[k])
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// quote makes s a DOT quoted string. Newlines become DOT line breaks.
+func quote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// Serve writes g as DOT when the request asks for it, with format=dot or by
+// accepting text/vnd.graphviz, and as JSON otherwise.
+func Serve(w http.ResponseWriter, req *http.Request, g *Graph) {
+	if req.URL.Query().Get("format") == "dot" || strings.Contains(req.Header.Get("Accept"), "text/vnd.graphviz") {
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		_ = g.WriteDOT(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(g)
+}
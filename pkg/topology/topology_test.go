@@ -0,0 +1,133 @@
+/*
+Copyright 2022 Scott Nichols
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package topology
+
+import (
+	"strings"
+	"testing"
+
+	eventingv1 "knative.dev/eventing/pkg/apis/eventing/v1"
+	"knative.dev/pkg/apis"
+)
+
+func TestAdd(t *testing.T) {
+	sub, _ := apis.ParseURL("http://sub.default.svc")
+	dls, _ := apis.ParseURL("http://dls.default.svc")
+
+	b := &eventingv1.Broker{}
+	b.Name, b.Namespace = "default", "default"
+	b.Annotations = map[string]string{SettingsPrefix + "queue-depth": "10"}
+
+	t1 := &eventingv1.Trigger{}
+	t1.Name, t1.Namespace = "b", "default"
+	t1.Spec.Filter = &eventingv1.TriggerFilter{Attributes: eventingv1.TriggerFilterAttributes{"type": "a.b"}}
+	t1.Status.SubscriberURI = sub
+	t1.Status.DeadLetterSinkURI = dls
+
+	t2 := &eventingv1.Trigger{}
+	t2.Name, t2.Namespace = "a", "default"
+	t2.Status.SubscriberURI = sub
+
+	g := New()
+	g.Add(b, []*eventingv1.Trigger{t1, t2})
+
+	var ids []string
+	for _, n := range g.Nodes {
+		ids = append(ids, n.ID)
+	}
+	want := []string{
+		"broker/default/default",
+		"trigger/default/a",
+		"uri/http://sub.default.svc",
+		"trigger/default/b",
+		"uri/http://dls.default.svc",
+	}
+	if strings.Join(ids, ",") != strings.Join(want, ",") {
+		t.Errorf("nodes = %v, want %v", ids, want)
+	}
+	if len(g.Edges) != 5 {
+		t.Errorf("got %d edges, want 5: %+v", len(g.Edges), g.Edges)
+	}
+	if got := g.index["broker/default/default"].Settings["queue-depth"]; got != "10" {
+		t.Errorf("broker settings queue-depth = %q, want 10", got)
+	}
+
+	var dot strings.Builder
+	if err := g.WriteDOT(&dot); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`"trigger/default/b" [shape=box, label="Trigger\ndefault/b\nNOT READY\ntype=a.b"];`,
+		`"trigger/default/b" -> "uri/http://dls.default.svc" [label="deadLetters", style=dashed];`,
+	} {
+		if !strings.Contains(dot.String(), s) {
+			t.Errorf("DOT is missing %s:\n%s", s, dot.String())
+		}
+	}
+}
+
+func TestFilterExpression(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters []eventingv1.SubscriptionsAPIFilter
+		want    string
+	}{{
+		name:    "exact",
+		filters: []eventingv1.SubscriptionsAPIFilter{{Exact: map[string]string{"type": "a.b"}}},
+		want:    "type = 'a.b'",
+	}, {
+		name: "filters are anded",
+		filters: []eventingv1.SubscriptionsAPIFilter{
+			{Prefix: map[string]string{"type": "dev.knative_"}},
+			{Suffix: map[string]string{"source": "100%"}},
+		},
+		want: `(type LIKE 'dev.knative\_%' AND source LIKE '%100\%')`,
+	}, {
+		name: "nested dialects",
+		filters: []eventingv1.SubscriptionsAPIFilter{{Any: []eventingv1.SubscriptionsAPIFilter{
+			{Exact: map[string]string{"type": "it's"}},
+			{Not: &eventingv1.SubscriptionsAPIFilter{CESQL: "source LIKE 'x%'"}},
+		}}},
+		want: `(type = 'it''s' OR NOT (source LIKE 'x%'))`,
+	}, {
+		name:    "empty filter",
+		filters: []eventingv1.SubscriptionsAPIFilter{{}},
+		want:    "TRUE",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := FilterExpression(tc.filters); got != tc.want {
+				t.Errorf("FilterExpression() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAddFilters(t *testing.T) {
+	b := &eventingv1.Broker{}
+	b.Name, b.Namespace = "default", "default"
+
+	trigger := &eventingv1.Trigger{}
+	trigger.Name, trigger.Namespace = "a", "default"
+	// Filters override the attribute filter.
+	trigger.Spec.Filter = &eventingv1.TriggerFilter{Attributes: eventingv1.TriggerFilterAttributes{"type": "ignored"}}
+	trigger.Spec.Filters = []eventingv1.SubscriptionsAPIFilter{{Prefix: map[string]string{"type": "a."}}}
+
+	g := New()
+	g.Add(b, []*eventingv1.Trigger{trigger})
+
+	n := g.index["trigger/default/a"]
+	if n.Filter != nil || n.Filters != "type LIKE 'a.%'" {
+		t.Errorf("filter = %v, filters = %q, want only filters", n.Filter, n.Filters)
+	}
+	var dot strings.Builder
+	if err := g.WriteDOT(&dot); err != nil {
+		t.Fatal(err)
+	}
+	if want := `label="Trigger\ndefault/a\nNOT READY\ntype LIKE 'a.%'"`; !strings.Contains(dot.String(), want) {
+		t.Errorf("DOT is missing %s:\n%s", want, dot.String())
+	}
+}